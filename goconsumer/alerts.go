@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"rules"
+	"syscall"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// watchRules reloads the rules file when it changes or on SIGHUP
+func watchRules(engine *rules.Engine, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	for {
+		reload := false
+		select {
+		case <-hup:
+			reload = true
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Println("Failed to stat rules file", err)
+			continue
+		}
+		if !reload && info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+
+		cfg, err := rules.LoadFile(path)
+		if err == nil {
+			err = engine.Reload(cfg)
+		}
+		if err != nil {
+			log.Println("Failed to reload rules, keeping previous rules.", err)
+			continue
+		}
+		log.Printf("%% Loaded %d rules from %s\n", len(cfg.Rules), path)
+	}
+}
+
+// deliverAlerts writes alerts to the alerts log file, the alerts topic and
+// the webhooks of their rule
+func deliverAlerts(alerts []rules.Alert) {
+	topic := os.Getenv("TOPICNAMEALERTS")
+	for _, a := range alerts {
+		log.Printf("%% Alert %s on %s: %s %.2f\n", a.Rule, a.Camera, a.Class, a.Score)
+
+		docBytes, err := json.Marshal(a)
+		if err != nil {
+			log.Println("Json marshalling error. Error:", err.Error())
+			continue
+		}
+
+		if alertsLog != nil {
+			_, err = alertsLog.Write(append(docBytes, '\n'))
+			if err != nil {
+				log.Println("Failed to write alerts log", err)
+			}
+		}
+
+		if topic != "" {
+			publish(topic, []byte(a.Camera), a)
+		}
+
+		if recorder != nil {
+			recorder.Trigger(a.Camera, a.Time, a)
+		}
+
+		for _, url := range a.Webhooks {
+			go postWebhook(url, docBytes)
+		}
+	}
+}
+
+func postWebhook(url string, docBytes []byte) {
+	res, err := webhookClient.Post(url, "application/json", bytes.NewReader(docBytes))
+	if err != nil {
+		log.Println("Error in webhook", url, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Println("Error in webhook", url, res.Status)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"counter"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// countsEvent is a periodic counts report as published to Kafka
+type countsEvent struct {
+	Camera string `json:"camera"`
+	counter.Counts
+	Time time.Time `json:"time"`
+}
+
+// loadCounts reads counts persisted by a previous run, if any
+func loadCounts(path string) map[string]counter.Counts {
+	counts := make(map[string]counter.Counts)
+	dat, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return counts
+	}
+	if err != nil {
+		log.Fatal("Failed to read counts file", err)
+	}
+	err = json.Unmarshal(dat, &counts)
+	if err != nil {
+		log.Fatal("Invalid counts file", err)
+	}
+	return counts
+}
+
+// snapshotCounts returns the current counts of every camera
+func snapshotCounts() map[string]counter.Counts {
+	counts := make(map[string]counter.Counts, len(counters))
+	for camera, c := range counters {
+		counts[camera] = c.Snapshot()
+	}
+	return counts
+}
+
+// reportCounts periodically persists the counts to disk and publishes them
+// to the counts topic
+func reportCounts(interval time.Duration) {
+	path := os.Getenv("COUNTSFILE")
+	topic := os.Getenv("TOPICNAMECOUNTS")
+
+	for now := range time.Tick(interval) {
+		counts := snapshotCounts()
+
+		if path != "" {
+			dat, err := json.Marshal(counts)
+			if err != nil {
+				log.Println("Json marshalling error. Error:", err.Error())
+				continue
+			}
+			// Write then rename so a crash never leaves a truncated file
+			err = ioutil.WriteFile(path+".tmp", dat, 0644)
+			if err == nil {
+				err = os.Rename(path+".tmp", path)
+			}
+			if err != nil {
+				log.Println("Failed to save counts", err)
+			}
+		}
+
+		if topic != "" {
+			for camera, c := range counts {
+				publish(topic, []byte(camera), countsEvent{Camera: camera, Counts: c, Time: now})
+			}
+		}
+	}
+}
+
+// serveCounts responds with the counts of every camera, or of the camera
+// given by the `camera` query parameter
+func serveCounts(w http.ResponseWriter, r *http.Request) {
+	var v interface{} = snapshotCounts()
+	if camera := r.URL.Query().Get("camera"); camera != "" {
+		c, ok := counters[camera]
+		if !ok {
+			http.Error(w, "Unknown camera "+camera, http.StatusNotFound)
+			return
+		}
+		v = c.Snapshot()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("Error in Encode:", err)
+	}
+}
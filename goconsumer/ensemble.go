@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"models"
+	"os"
+	"sort"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// ensembleEvent is a consolidated prediction as published to Kafka
+type ensembleEvent struct {
+	Camera   string `json:"camera"`
+	Ensemble string `json:"ensemble"`
+	models.Consensus
+	Time time.Time `json:"time"`
+}
+
+// drawEnsembles combines the member predictions of each ensemble, draws the
+// consensus below the model predictions and publishes it when any member
+// has a new prediction for the camera
+func drawEnsembles(frame *gocv.Mat, camera string, preds map[string]models.Output, updated map[string]bool, now time.Time) {
+	var names []string
+	for name := range ensembles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	topic := os.Getenv("TOPICNAMEENSEMBLES")
+	for ii, name := range names {
+		param := ensembles[name]
+		cons := param.Combine(preds)
+
+		gocv.PutText(
+			frame,
+			fmt.Sprintf("%s : %s (%.0f%% agree)", name, cons.Class, cons.Agreement*100),
+			image.Pt(10, (len(modelParams)+ii)*20+20),
+			gocv.FontHersheyPlain, 1.2,
+			statusColor, 2,
+		)
+
+		if topic == "" {
+			continue
+		}
+		for member := range param.Members {
+			if updated[member] {
+				publish(topic, []byte(camera), ensembleEvent{
+					Camera:    camera,
+					Ensemble:  name,
+					Consensus: cons,
+					Time:      now,
+				})
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"confluentkafkago"
+	"encoding/json"
+	"log"
+	"models"
+	"os"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+var events = make(chan eventMsg, 100)
+
+// Topic of per-frame model predictions, none if empty
+var predictionsTopic = os.Getenv("TOPICNAMEPREDICTIONS")
+
+// predictionEvent is a model prediction published to predictionsTopic
+type predictionEvent struct {
+	Camera     string             `json:"camera"`
+	Model      string             `json:"model"`
+	Class      string             `json:"class"`
+	Score      float64            `json:"score"`
+	Detections []models.Detection `json:"detections,omitempty"`
+	Version    string             `json:"version,omitempty"`
+	Latency    float64            `json:"latency"` //Seconds
+	Time       time.Time          `json:"time"`
+}
+
+type eventMsg struct {
+	topic string
+	key   []byte
+	value interface{}
+}
+
+// publish queues value to be written as json into topic, dropping it if the
+// queue is full
+func publish(topic string, key []byte, value interface{}) {
+	select {
+	case events <- eventMsg{topic: topic, key: key, value: value}:
+	default:
+		log.Println("Event queue full, dropping event for", topic)
+	}
+}
+
+func writeEvents(events chan eventMsg) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("main.writeEvents():PANICKED AND RESTARTING")
+			log.Println("Panic:", r)
+			go writeEvents(events)
+		}
+	}()
+
+	broker := os.Getenv("KAFKAPORTOUT")
+	compression := os.Getenv("COMPRESSIONTYPE")
+
+	p, _, err := confluentkafkago.NewProducer(broker, compression)
+	if err != nil {
+		p.Close()
+		log.Panic(err)
+	}
+	defer func() {
+		// Close the producer
+		p.Flush(10000)
+		p.Close()
+	}()
+
+	for ev := range events {
+		//Prepare message to be sent to Kafka
+		docBytes, err := json.Marshal(ev.value)
+		if err != nil {
+			log.Println("Json marshalling error. Error:", err.Error())
+			continue
+		}
+
+		//Send message into Kafka queue
+		topic := ev.topic
+		p.ProduceChannel() <- &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Key:            ev.key,
+			Value:          docBytes,
+			Timestamp:      time.Now(),
+		}
+	}
+}
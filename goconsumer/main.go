@@ -1,28 +1,59 @@
 package main
 
 import (
+	"clips"
 	"confluentkafkago"
+	"counter"
 	"encoding/json"
 	"log"
 	"models"
+	"net"
+	"net/http"
 	"os"
+	"rules"
 	"strings"
+	"sync"
+	"tfmock"
 	"time"
+	"tracker"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/pkg/profile"
-	"gocv.io/x/gocv"
 )
 
 var modelurls = make(map[string]string)
 var labelurls = make(map[string]string)
+var preprocess = make(map[string]models.Preprocess)
+var modelSpecs = make(map[string]models.ModelSpec)
+var kserveParams = make(map[string]models.KServeParam)
+var localParams = make(map[string]models.LocalParam)
+var fallbacks = make(map[string]models.FallbackParam)
+var regions = make(map[string][]models.Region)
+var caches = make(map[string]models.CacheParam)
+var motion *motionParam
+var tracking *tracker.Param
+var counters = make(map[string]*counter.Counter)
+var alertRules *rules.Engine
+var alertsLog *os.File
+var recorder *clips.Recorder
+var privacy *anonymizer
+var ensembles = make(map[string]models.EnsembleParam)
+var routes = make(map[string]*route)
+var motionDetectors = make(map[string]*motionDetector)
 var modelParams = make(map[int]*modelParam)
-var videoDisplay = make(chan gocv.Mat)
+var videoDisplay = make(chan displayMsg)
 
 type modelParam struct {
 	modelHandler models.Handler
 	modelName    string
-	pred         string
+	outputs      map[string]models.Output    //Latest prediction per camera
+	trackers     map[string]*tracker.Tracker //Tracker per camera
+	route        *route                      //Shadow or canary candidate, if any
+}
+
+type displayMsg struct {
+	camera []byte
+	doc    topicMsg //Annotated frame to republish
 }
 
 func init() {
@@ -35,34 +66,309 @@ func init() {
 	if err != nil {
 		log.Fatal("Invalid label urls", err)
 	}
+	if val, ok := os.LookupEnv("MODELSPECS"); ok {
+		err = json.Unmarshal([]byte(val), &modelSpecs)
+		if err != nil {
+			log.Fatal("Invalid model specs", err)
+		}
+	}
+	if val, ok := os.LookupEnv("KSERVE"); ok {
+		err = json.Unmarshal([]byte(val), &kserveParams)
+		if err != nil {
+			log.Fatal("Invalid kserve params", err)
+		}
+	}
+	if val, ok := os.LookupEnv("LOCAL"); ok {
+		err = json.Unmarshal([]byte(val), &localParams)
+		if err != nil {
+			log.Fatal("Invalid local params", err)
+		}
+	}
+	if val, ok := os.LookupEnv("PREPROCESS"); ok {
+		err = json.Unmarshal([]byte(val), &preprocess)
+		if err != nil {
+			log.Fatal("Invalid preprocess", err)
+		}
+	}
+	if val, ok := os.LookupEnv("REGIONS"); ok {
+		err = json.Unmarshal([]byte(val), &regions)
+		if err != nil {
+			log.Fatal("Invalid regions", err)
+		}
+		for _, rgs := range regions {
+			for _, rg := range rgs {
+				if err := rg.Validate(); err != nil {
+					log.Fatal("Invalid regions", err)
+				}
+			}
+		}
+	}
+	if val, ok := os.LookupEnv("MOTION"); ok {
+		motion = &motionParam{}
+		err = json.Unmarshal([]byte(val), motion)
+		if err != nil {
+			log.Fatal("Invalid motion", err)
+		}
+		if err := motion.validate(); err != nil {
+			log.Fatal("Invalid motion", err)
+		}
+	}
+	if val, ok := os.LookupEnv("TRACKING"); ok {
+		tracking = &tracker.Param{}
+		err = json.Unmarshal([]byte(val), tracking)
+		if err != nil {
+			log.Fatal("Invalid tracking", err)
+		}
+		if err := tracking.Validate(); err != nil {
+			log.Fatal("Invalid tracking", err)
+		}
+	}
+	if val, ok := os.LookupEnv("COUNTERS"); ok {
+		cfgs := make(map[string]counter.Config)
+		err = json.Unmarshal([]byte(val), &cfgs)
+		if err != nil {
+			log.Fatal("Invalid counters", err)
+		}
+		if tracking == nil {
+			log.Fatal("Counters require TRACKING")
+		}
+		saved := loadCounts(os.Getenv("COUNTSFILE"))
+		for camera, cfg := range cfgs {
+			if err := cfg.Validate(); err != nil {
+				log.Fatal("Invalid counters", err)
+			}
+			if _, ok := modelurls[cfg.Model]; !ok {
+				log.Fatal("Unknown counter model " + cfg.Model)
+			}
+			counters[camera] = counter.New(cfg, saved[camera])
+		}
+	}
+	if path, ok := os.LookupEnv("RULESFILE"); ok {
+		cfg, err := rules.LoadFile(path)
+		if err != nil {
+			log.Fatal("Invalid rules", err)
+		}
+		alertRules = rules.New()
+		if err := alertRules.Reload(cfg); err != nil {
+			log.Fatal("Invalid rules", err)
+		}
+		go watchRules(alertRules, path)
+	}
+	if path, ok := os.LookupEnv("ALERTSLOG"); ok {
+		alertsLog, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal("Failed to open alerts log", err)
+		}
+	}
+	if val, ok := os.LookupEnv("CLIPS"); ok {
+		var param clips.Param
+		err = json.Unmarshal([]byte(val), &param)
+		if err != nil {
+			log.Fatal("Invalid clips", err)
+		}
+		recorder, err = clips.New(param)
+		if err != nil {
+			log.Fatal("Invalid clips", err)
+		}
+	}
+	if val, ok := os.LookupEnv("PRIVACY"); ok {
+		var param privacyParam
+		err = json.Unmarshal([]byte(val), &param)
+		if err != nil {
+			log.Fatal("Invalid privacy", err)
+		}
+		privacy, err = newAnonymizer(param)
+		if err != nil {
+			log.Fatal("Invalid privacy", err)
+		}
+	}
+	if val, ok := os.LookupEnv("ENSEMBLES"); ok {
+		err = json.Unmarshal([]byte(val), &ensembles)
+		if err != nil {
+			log.Fatal("Invalid ensembles", err)
+		}
+		for _, param := range ensembles {
+			if err := param.Validate(); err != nil {
+				log.Fatal("Invalid ensembles", err)
+			}
+			for member := range param.Members {
+				if _, ok := modelurls[member]; !ok {
+					log.Fatal("Unknown ensemble member " + member)
+				}
+			}
+		}
+	}
+	candidates := make(map[string]models.Handler)
+	if val, ok := os.LookupEnv("ROUTING"); ok {
+		params := make(map[string]routeParam)
+		err = json.Unmarshal([]byte(val), &params)
+		if err != nil {
+			log.Fatal("Invalid routing", err)
+		}
+		for modelName, param := range params {
+			if err := param.validate(); err != nil {
+				log.Fatal("Invalid routing", err)
+			}
+			_, okPrimary := modelurls[modelName]
+			_, okCandidate := modelurls[param.Candidate]
+			if !okPrimary || !okCandidate {
+				log.Fatal("Unknown routed model " + modelName + " or " + param.Candidate)
+			}
+			routes[modelName] = newRoute(modelName, param)
+			candidates[param.Candidate] = nil
+		}
+	}
+	fallbackModels := make(map[string]bool)
+	if val, ok := os.LookupEnv("FALLBACK"); ok {
+		err = json.Unmarshal([]byte(val), &fallbacks)
+		if err != nil {
+			log.Fatal("Invalid fallback", err)
+		}
+		for modelName, param := range fallbacks {
+			_, okRemote := modelurls[modelName]
+			_, okLocal := modelurls[param.Model]
+			if !okRemote || !okLocal || !strings.HasPrefix(param.Model, "local_") {
+				log.Fatal("Unknown fallback model " + modelName + " or " + param.Model)
+			}
+			fallbackModels[param.Model] = true
+		}
+	}
+	if val, ok := os.LookupEnv("CACHE"); ok {
+		err = json.Unmarshal([]byte(val), &caches)
+		if err != nil {
+			log.Fatal("Invalid cache", err)
+		}
+	}
 
-	//Create models and start prediction
+	// Serve fake models, for demos without TF Serving
+	if val, ok := os.LookupEnv("TFMOCK"); ok {
+		var param struct {
+			Addr   string         `json:"addr"`
+			Cert   string         `json:"cert"` //TLS certificate and key files, to also serve gRPC
+			Key    string         `json:"key"`
+			Models []tfmock.Model `json:"models"`
+		}
+		err = json.Unmarshal([]byte(val), &param)
+		if err != nil {
+			log.Fatal("Invalid tfmock", err)
+		}
+		srv, err := tfmock.New(param.Models...)
+		if err != nil {
+			log.Fatal("Invalid tfmock", err)
+		}
+		ln, err := net.Listen("tcp", param.Addr)
+		if err != nil {
+			log.Fatal("Failed to listen for tfmock", err)
+		}
+		go func() {
+			if param.Cert != "" {
+				log.Fatal(http.ServeTLS(ln, srv, param.Cert, param.Key))
+			}
+			log.Fatal(http.Serve(ln, srv))
+		}()
+	}
+
+	// Create the models concurrently, since each waits for its served model
+	// to be checked
+	handlers := make(map[string]models.Handler)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for modelName := range modelurls {
+		wg.Add(1)
+		go func(modelName string) {
+			defer wg.Done()
+			modelHandler := newHandler(modelName)
+			lock.Lock()
+			handlers[modelName] = modelHandler
+			lock.Unlock()
+		}(modelName)
+	}
+	wg.Wait()
+
+	//Start prediction
 	ind := -1
-	for modelName, modelurl := range modelurls {
-		labelurl, ok := labelurls[modelName]
-		if !ok {
-			log.Fatal("Missing label url", err)
+	for modelName := range modelurls {
+		// Fallback models are used along with their remote model
+		if fallbackModels[modelName] {
+			continue
 		}
+		modelHandler := handlers[modelName]
 
-		var modelHandler models.Handler
-		parts := strings.Split(modelName, "_")
-		switch parts[0] {
-		case "imagenet":
-			modelHandler, err = models.NewImagenet(modelurl, labelurl)
+		// Switch to a local model while the remote one is down
+		if fp, ok := fallbacks[modelName]; ok {
+			fallback, err := models.NewFallback(modelHandler, handlers[fp.Model], fp)
 			if err != nil {
-				log.Fatal("Failed to create modelHandler", err)
+				log.Fatal("Failed to create fallback", err)
 			}
-		default:
-			log.Fatal("Model not recognised")
+			modelHandler = fallback
+		}
+
+		// Skip the model for near-duplicate frames
+		if cp, ok := caches[modelName]; ok {
+			cache, err := models.NewCache(modelHandler, preprocess[modelName], cp)
+			if err != nil {
+				log.Fatal("Failed to create cache", err)
+			}
+			go logCacheStats(modelName, cache)
+			modelHandler = cache
 		}
 		go modelHandler.Predict()
 
+		// Candidates only receive frames through their primary model
+		if _, ok := candidates[modelName]; ok {
+			candidates[modelName] = modelHandler
+			continue
+		}
+
 		ind = ind + 1
 		modelParams[ind] = &modelParam{
 			modelHandler: modelHandler,
 			modelName:    modelName,
-			pred:         "Nothing"}
+			outputs:      make(map[string]models.Output),
+			trackers:     make(map[string]*tracker.Tracker),
+			route:        routes[modelName]}
+	}
+	for _, rt := range routes {
+		rt.candidate = candidates[rt.param.Candidate]
+		if rt.canary != nil {
+			rt.canary.modelHandler = rt.candidate
+		}
+	}
+}
+
+// newHandler creates the handler of a model, by the prefix of its name
+func newHandler(modelName string) models.Handler {
+	modelurl := modelurls[modelName]
+	labelurl, ok := labelurls[modelName]
+	if !ok {
+		log.Fatal("Missing label url " + modelName)
+	}
+
+	var modelHandler models.Handler
+	var err error
+	parts := strings.Split(modelName, "_")
+	switch parts[0] {
+	case "imagenet":
+		modelHandler, err = models.NewImagenet(modelurl, labelurl, preprocess[modelName], modelSpecs[modelName])
+	case "ssd":
+		modelHandler, err = models.NewSSD(modelurl, labelurl, preprocess[modelName], modelSpecs[modelName])
+	case "kserve":
+		modelHandler, err = models.NewKServe(modelurl, labelurl, preprocess[modelName], modelSpecs[modelName], kserveParams[modelName])
+	case "local":
+		modelHandler, err = models.NewLocal(modelurl, labelurl, preprocess[modelName], localParams[modelName])
+	default:
+		log.Fatal("Model not recognised")
+	}
+
+	// Models with a fallback may start before they are served
+	if _, ok := fallbacks[modelName]; ok && err == models.ErrNotServing {
+		log.Println("Model", modelName, "not served, starting on its fallback")
+		err = nil
 	}
+	if err != nil {
+		log.Fatal("Failed to create modelHandler", err)
+	}
+	return modelHandler
 }
 
 func main() {
@@ -92,6 +398,25 @@ func main() {
 
 	// Start goroutine to write back processed data into Kafka queue
 	go writeOutput(videoDisplay)
+	go writeEvents(events)
+
+	// Report counts periodically
+	if len(counters) > 0 {
+		interval, err := time.ParseDuration(os.Getenv("COUNTSINTERVAL"))
+		if err != nil {
+			log.Fatal("Invalid counts interval", err)
+		}
+		go reportCounts(interval)
+	}
+
+	// Start http server
+	if httpport, ok := os.LookupEnv("HTTPPORT"); ok {
+		http.HandleFunc("/counts", serveCounts)
+		http.HandleFunc("/routes", serveRoutes)
+		go func() {
+			log.Fatal(http.ListenAndServe(httpport, nil))
+		}()
+	}
 
 	// Consume messages
 	for e := range c.Events() {
@@ -124,9 +449,21 @@ func main() {
 		// Reset offset to latest committed message
 		confluentkafkago.LatestOffset(c, 100)
 	}
+
+	// Write the clips still being recorded
+	if recorder != nil {
+		recorder.Close()
+	}
 }
 
-func writeOutput(videoDisplay chan gocv.Mat) {
+func logCacheStats(modelName string, cache *models.Cache) {
+	for range time.Tick(time.Minute) {
+		hits, misses := cache.Stats()
+		log.Printf("%% Cache %s: %d hits, %d misses\n", modelName, hits, misses)
+	}
+}
+
+func writeOutput(videoDisplay chan displayMsg) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Println("main.writeOutput():PANICKED AND RESTARTING")
@@ -150,18 +487,10 @@ func writeOutput(videoDisplay chan gocv.Mat) {
 		p.Close()
 	}()
 
-	for frame := range videoDisplay {
-		//Form the struct to be sent to Kafka message queue
-		doc := topicMsg{
-			Mat:      frame.ToBytes(),
-			Channels: frame.Channels(),
-			Rows:     frame.Rows(),
-			Cols:     frame.Cols(),
-			Type:     frame.Type(),
-		}
+	for msg := range videoDisplay {
 
 		//Prepare message to be sent to Kafka
-		docBytes, err := json.Marshal(doc)
+		docBytes, err := json.Marshal(msg.doc)
 		if err != nil {
 			log.Println("Json marshalling error. Error:", err.Error())
 			continue
@@ -170,6 +499,7 @@ func writeOutput(videoDisplay chan gocv.Mat) {
 		//Send message into Kafka queue
 		p.ProduceChannel() <- &kafka.Message{
 			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Key:            msg.camera,
 			Value:          docBytes,
 			Timestamp:      time.Now(),
 		}
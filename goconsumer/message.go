@@ -6,12 +6,14 @@ import (
 	"image/color"
 	"log"
 	"models"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"gocv.io/x/gocv"
 )
 
 var statusColor = color.RGBA{200, 150, 50, 0}
+var regionColor = color.RGBA{50, 200, 50, 0}
 
 func message(ev *kafka.Message) error {
 
@@ -31,27 +33,120 @@ func message(ev *kafka.Message) error {
 		return err
 	}
 
+	// Keep the capture time of frames from producers predating it
+	captured := doc.Timestamp
+	if captured.IsZero() {
+		captured = ev.Timestamp
+	}
+
+	// Regions of interest of the camera, keyed by message key
+	camera := string(ev.Key)
+	rgs := regions[camera]
+
+	// The models analyse the original frame, while the copy which is
+	// annotated, recorded and republished is anonymized
+	view := frame
+	if privacy != nil && privacy.enabled(camera) {
+		view = frame.Clone()
+		defer view.Close()
+		privacy.apply(&view)
+	}
+
+	// Only forward frames to the models when the scene changes
+	moved := true
+	if motion != nil {
+		md, ok := motionDetectors[camera]
+		if !ok {
+			md = newMotionDetector(*motion)
+			motionDetectors[camera] = md
+		}
+		moved = md.moved(frame)
+	}
+
+	// Predictions drawn on the frame, for recorded clips
+	preds := make(map[string]models.Output, len(modelParams))
+	updated := make(map[string]bool)
+
 	// Form output image
 	for ind := 0; ind < len(modelParams); ind++ {
 		mp := modelParams[ind]
 
 		// Get prediction
 		res, err := mp.modelHandler.Get()
-		if err == nil {
-			mp.pred = res.Class
+		if err == nil && (mp.route == nil || mp.route.observePrimary(res)) {
+			handleOutput(mp, res)
+			updated[mp.modelName] = res.Camera == camera
+		}
+
+		// Get candidate prediction, which serves the frames routed to it in
+		// canary mode
+		if mp.route != nil {
+			res, err := mp.route.candidate.Get()
+			if err == nil && mp.route.observeCandidate(res) {
+				handleOutput(mp.route.canary, res)
+				updated[mp.modelName] = updated[mp.modelName] || res.Camera == camera
+			}
+		}
+		sp := mp.serving(camera)
+		out, ok := sp.outputs[camera]
+		if ok {
+			preds[mp.modelName] = out
+		} else {
+			out.Class = "Nothing"
+		}
+
+		// Draw tracks, or raw detections when not tracking, to frame
+		if tr, ok := sp.trackers[camera]; ok {
+			drawTracks(&view, tr)
+		} else {
+			for _, det := range out.Detections {
+				gocv.Rectangle(&view, det.Box, statusColor, 2)
+				gocv.PutText(
+					&view,
+					det.Class,
+					image.Pt(det.Box.Min.X, det.Box.Min.Y-5),
+					gocv.FontHersheyPlain, 1.2,
+					statusColor, 2,
+				)
+			}
 		}
 
 		// Write prediction to frame
 		gocv.PutText(
-			&frame,
-			mp.modelName+" : "+mp.pred,
+			&view,
+			mp.modelName+" : "+out.Class,
 			image.Pt(10, ind*20+20),
 			gocv.FontHersheyPlain, 1.2,
 			statusColor, 2,
 		)
 
-		// Post next frame
-		mp.modelHandler.Post(models.Input{Img: frame})
+		// Post next frame, holding the last prediction while idle
+		if moved {
+			input := models.Input{Img: frame, Camera: camera, Regions: rgs, Time: captured}
+			if mp.route != nil {
+				mp.route.post(mp.modelHandler, input)
+			} else {
+				mp.modelHandler.Post(input)
+			}
+		}
+	}
+
+	// Combine predictions of ensembles
+	drawEnsembles(&view, camera, preds, updated, captured)
+
+	// Outline regions of interest
+	for _, rg := range rgs {
+		gocv.Polylines(&view, [][]image.Point{rg.Points()}, true, regionColor, 1)
+	}
+
+	// Buffer frame for clips around alerts
+	if recorder != nil {
+		buf, err := gocv.IMEncode(gocv.JPEGFileExt, view)
+		if err != nil {
+			log.Println("Error in IMEncode:", err)
+		} else {
+			recorder.Add(camera, captured, buf, preds)
+		}
 	}
 
 	// Write image to output Kafka queue
@@ -59,15 +154,58 @@ func message(ev *kafka.Message) error {
 	// case videoDisplay <- frame:
 	// default:
 	// }
-	videoDisplay <- frame
+	// The view is copied out, as an anonymized one is closed on return
+	videoDisplay <- displayMsg{camera: ev.Key, doc: topicMsg{
+		Mat:       view.ToBytes(),
+		Channels:  view.Channels(),
+		Rows:      view.Rows(),
+		Cols:      view.Cols(),
+		Type:      view.Type(),
+		Timestamp: captured,
+		Seq:       doc.Seq,
+	}}
 
 	return nil
 }
 
+// handleOutput stores and publishes a new prediction of a model and feeds it
+// to the trackers and alert rules at the capture time of its frame. The
+// initial prediction of a handler, which has no camera, is dropped.
+func handleOutput(mp *modelParam, res models.Output) {
+	if res.Camera == "" {
+		return
+	}
+	now := res.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	mp.outputs[res.Camera] = res
+	if predictionsTopic != "" {
+		publish(predictionsTopic, []byte(res.Camera), predictionEvent{
+			Camera:     res.Camera,
+			Model:      mp.modelName,
+			Class:      res.Class,
+			Score:      res.Score,
+			Detections: res.Detections,
+			Version:    res.Version,
+			Latency:    res.Latency.Seconds(),
+			Time:       now,
+		})
+	}
+	if tracking != nil {
+		updateTracks(mp, res, now)
+	}
+	if alertRules != nil {
+		deliverAlerts(alertRules.Evaluate(res.Camera, mp.modelName, res, now))
+	}
+}
+
 type topicMsg struct {
-	Mat      []byte       `json:"mat"`
-	Channels int          `json:"channels"`
-	Rows     int          `json:"rows"`
-	Cols     int          `json:"cols"`
-	Type     gocv.MatType `json:"type"`
+	Mat       []byte       `json:"mat"`
+	Channels  int          `json:"channels"`
+	Rows      int          `json:"rows"`
+	Cols      int          `json:"cols"`
+	Type      gocv.MatType `json:"type"`
+	Timestamp time.Time    `json:"timestamp"` //Capture time of the frame
+	Seq       uint64       `json:"seq"`       //Frame number of the camera
 }
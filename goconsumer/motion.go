@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"image"
+
+	"gocv.io/x/gocv"
+)
+
+// motionParam configures the motion detector placed in front of the models
+type motionParam struct {
+	Method    string  `json:"method"`    //"diff" for frame differencing or "mog2" for background subtraction
+	Threshold float64 `json:"threshold"` //Fraction of changed pixels above which frames are forwarded
+}
+
+func (mp motionParam) validate() error {
+	switch mp.Method {
+	case "diff", "mog2":
+	default:
+		return errors.New("Unknown motion method " + mp.Method)
+	}
+	if mp.Threshold < 0 || mp.Threshold > 1 {
+		return errors.New("motion threshold must be between 0 and 1")
+	}
+	return nil
+}
+
+// motionDetector keeps the per camera state needed to detect motion
+type motionDetector struct {
+	param motionParam
+	prev  gocv.Mat
+	mog2  gocv.BackgroundSubtractorMOG2
+}
+
+func newMotionDetector(param motionParam) *motionDetector {
+	md := &motionDetector{param: param, prev: gocv.NewMat()}
+	if param.Method == "mog2" {
+		md.mog2 = gocv.NewBackgroundSubtractorMOG2()
+	}
+	return md
+}
+
+// moved reports whether the fraction of changed pixels in frame exceeds the
+// threshold
+func (md *motionDetector) moved(frame gocv.Mat) bool {
+	mask := gocv.NewMat()
+	defer mask.Close()
+
+	switch md.param.Method {
+	case "mog2":
+		md.mog2.Apply(frame, &mask)
+		// Drop shadows, which MOG2 marks as 127
+		gocv.Threshold(mask, &mask, 200, 255, gocv.ThresholdBinary)
+	default:
+		gray := gocv.NewMat()
+		gocv.CvtColor(frame, &gray, gocv.ColorBGRToGray)
+		gocv.GaussianBlur(gray, &gray, image.Pt(21, 21), 0, 0, gocv.BorderDefault)
+		if md.prev.Empty() || md.prev.Rows() != gray.Rows() || md.prev.Cols() != gray.Cols() {
+			md.prev.Close()
+			md.prev = gray
+			return true
+		}
+		gocv.AbsDiff(md.prev, gray, &mask)
+		gocv.Threshold(mask, &mask, 25, 255, gocv.ThresholdBinary)
+		md.prev.Close()
+		md.prev = gray
+	}
+
+	total := mask.Rows() * mask.Cols()
+	if total == 0 {
+		return true
+	}
+	return float64(gocv.CountNonZero(mask))/float64(total) > md.param.Threshold
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"image"
+
+	"gocv.io/x/gocv"
+)
+
+// privacyParam configures anonymization of frames before they are shown or
+// recorded
+type privacyParam struct {
+	Cascades []string        `json:"cascades"` //Cascade classifier files, e.g. faces and plates
+	Method   string          `json:"method"`   //"blur" or "pixelate"
+	Cameras  map[string]bool `json:"cameras"`  //Cameras to anonymize
+}
+
+// anonymizer hides faces and license plates found by cascade classifiers
+type anonymizer struct {
+	param       privacyParam
+	classifiers []gocv.CascadeClassifier
+}
+
+func newAnonymizer(param privacyParam) (*anonymizer, error) {
+	switch param.Method {
+	case "blur", "pixelate":
+	default:
+		return nil, errors.New("Unknown privacy method " + param.Method)
+	}
+	if len(param.Cascades) == 0 {
+		return nil, errors.New("privacy needs at least one cascade")
+	}
+
+	an := &anonymizer{param: param}
+	for _, path := range param.Cascades {
+		classifier := gocv.NewCascadeClassifier()
+		if !classifier.Load(path) {
+			classifier.Close()
+			return nil, errors.New("Failed to load cascade " + path)
+		}
+		an.classifiers = append(an.classifiers, classifier)
+	}
+	return an, nil
+}
+
+// enabled reports whether frames of the camera are anonymized
+func (an *anonymizer) enabled(camera string) bool {
+	return an.param.Cameras[camera]
+}
+
+// apply blurs or pixelates, in place, every area of frame found by the
+// classifiers
+func (an *anonymizer) apply(frame *gocv.Mat) {
+	var rects []image.Rectangle
+	for ii := range an.classifiers {
+		rects = append(rects, an.classifiers[ii].DetectMultiScale(*frame)...)
+	}
+
+	for _, r := range rects {
+		roi := frame.Region(r)
+		switch an.param.Method {
+		case "pixelate":
+			small := gocv.NewMat()
+			gocv.Resize(roi, &small, image.Pt(r.Dx()/10+1, r.Dy()/10+1), 0, 0, gocv.InterpolationLinear)
+			gocv.Resize(small, &roi, r.Size(), 0, 0, gocv.InterpolationNearestNeighbor)
+			small.Close()
+		default:
+			// Kernel size must be odd
+			k := r.Dx()/3 | 1
+			gocv.GaussianBlur(roi, &roi, image.Pt(k, k), 0, 0, gocv.BorderDefault)
+		}
+		roi.Close()
+	}
+}
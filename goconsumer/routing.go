@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"models"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"tracker"
+)
+
+// routeParam configures a candidate model deployed alongside a primary one
+type routeParam struct {
+	Candidate string  `json:"candidate"` //Name of the candidate model in MODELURLS
+	Mode      string  `json:"mode"`      //"shadow" or "canary"
+	Percent   float64 `json:"percent"`   //Share of traffic sent to the candidate in canary mode
+	By        string  `json:"by"`        //"camera" or "frame", how canary traffic is split
+}
+
+func (rp routeParam) validate() error {
+	switch rp.Mode {
+	case "shadow":
+	case "canary":
+		if rp.Percent < 0 || rp.Percent > 100 {
+			return errors.New("canary percent must be between 0 and 100")
+		}
+		if rp.By != "camera" && rp.By != "frame" {
+			return errors.New("canary by must be camera or frame")
+		}
+	default:
+		return errors.New("Unknown routing mode " + rp.Mode)
+	}
+	return nil
+}
+
+// route sends frames of a primary model to its candidate and compares them
+type route struct {
+	model     string //Name of the primary model
+	param     routeParam
+	candidate models.Handler
+	canary    *modelParam //Outputs and tracks of the candidate in canary mode
+	lock      sync.Mutex
+	pending   map[frameKey]*pending //Frames awaiting a prediction of either model
+	compared  int
+	agreed    int
+	latency   [2]time.Duration //Summed latency of primary and candidate
+	count     [2]int           //Number of timed predictions of primary and candidate
+}
+
+// frameKey identifies a frame of a camera by its capture time
+type frameKey struct {
+	camera string
+	time   int64
+}
+
+// pending holds the predictions of both models for one frame
+type pending struct {
+	primary   *models.Output
+	candidate *models.Output
+	canary    bool      //The frame was routed to the candidate
+	added     time.Time //When the first prediction or route arrived
+}
+
+// Time after which a frame missing a prediction is no longer compared
+const pendingTimeout = time.Minute
+
+// comparisonEvent pairs the predictions of a primary and candidate model for
+// the same frame
+type comparisonEvent struct {
+	Camera           string  `json:"camera"`
+	Model            string  `json:"model"`
+	Candidate        string  `json:"candidate"`
+	Mode             string  `json:"mode"`
+	PrimaryClass     string  `json:"primaryClass"`
+	CandidateClass   string  `json:"candidateClass"`
+	PrimaryVersion   string  `json:"primaryVersion"`
+	CandidateVersion string  `json:"candidateVersion"`
+	Agree            bool    `json:"agree"`
+	PrimaryLatency   float64 `json:"primaryLatencyMs"`
+	CandidateLatency float64 `json:"candidateLatencyMs"`
+}
+
+// routeReport summarises the comparison of a primary and candidate model
+type routeReport struct {
+	Candidate        string  `json:"candidate"`
+	Mode             string  `json:"mode"`
+	Percent          float64 `json:"percent,omitempty"`
+	Compared         int     `json:"compared"`
+	AgreementRate    float64 `json:"agreementRate"`
+	PrimaryLatency   float64 `json:"primaryLatencyMs"`
+	CandidateLatency float64 `json:"candidateLatencyMs"`
+	LatencyDelta     float64 `json:"latencyDeltaMs"` //Candidate minus primary
+}
+
+func newRoute(model string, param routeParam) *route {
+	rt := &route{model: model, param: param, pending: make(map[frameKey]*pending)}
+	if param.Mode == "canary" {
+		rt.canary = &modelParam{
+			modelName: model,
+			outputs:   make(map[string]models.Output),
+			trackers:  make(map[string]*tracker.Tracker),
+			route:     rt,
+		}
+	}
+	return rt
+}
+
+// post sends an input to the primary model and, in shadow mode or when it is
+// a canary frame, to the candidate. The primary prediction of a canary frame
+// is only compared.
+func (rt *route) post(primary models.Handler, input models.Input) {
+	canary := rt.param.Mode == "canary" && rt.toCandidate(input.Camera)
+	if canary {
+		rt.lock.Lock()
+		rt.entry(frameKey{input.Camera, input.Time.UnixNano()}).canary = true
+		rt.lock.Unlock()
+	}
+	primary.Post(input)
+	if rt.param.Mode == "shadow" || canary {
+		rt.candidate.Post(input)
+	}
+}
+
+// toCandidate reports whether a canary frame of the camera goes to the
+// candidate. Splitting by camera hashes the camera ID so each camera always
+// goes to the same model.
+func (rt *route) toCandidate(camera string) bool {
+	if rt.param.By == "camera" {
+		h := fnv.New32a()
+		h.Write([]byte(camera))
+		return float64(h.Sum32()%10000) < rt.param.Percent*100
+	}
+	return rand.Float64()*100 < rt.param.Percent
+}
+
+// observePrimary records a new prediction of the primary model and reports
+// whether it serves its frame, which canary frames leave to the candidate
+func (rt *route) observePrimary(out models.Output) bool {
+	return rt.observe(0, out)
+}
+
+// observeCandidate records a new prediction of the candidate and reports
+// whether it serves its frame, which only canary frames let it do
+func (rt *route) observeCandidate(out models.Output) bool {
+	return rt.observe(1, out)
+}
+
+// observe records a new prediction of the primary (0) or candidate (1) model
+// and compares it with the prediction of the other model for the same frame
+func (rt *route) observe(ind int, out models.Output) bool {
+	if out.Camera == "" {
+		return ind == 0
+	}
+	rt.lock.Lock()
+	rt.time(ind, out.Latency)
+	key := frameKey{out.Camera, out.Time.UnixNano()}
+	p := rt.entry(key)
+	if ind == 0 {
+		p.primary = &out
+	} else {
+		p.candidate = &out
+	}
+	serves := p.canary == (ind == 1)
+	if p.primary == nil || p.candidate == nil {
+		rt.lock.Unlock()
+		return serves
+	}
+	delete(rt.pending, key)
+	prim, cand := p.primary, p.candidate
+	agree := prim.Class == cand.Class
+	rt.compared++
+	if agree {
+		rt.agreed++
+	}
+	rt.lock.Unlock()
+
+	ev := comparisonEvent{
+		Camera:           out.Camera,
+		Model:            rt.model,
+		Candidate:        rt.param.Candidate,
+		Mode:             rt.param.Mode,
+		PrimaryClass:     prim.Class,
+		CandidateClass:   cand.Class,
+		PrimaryVersion:   prim.Version,
+		CandidateVersion: cand.Version,
+		Agree:            agree,
+		PrimaryLatency:   ms(prim.Latency),
+		CandidateLatency: ms(cand.Latency),
+	}
+	if topic := os.Getenv("TOPICNAMECOMPARISON"); topic != "" {
+		publish(topic, []byte(out.Camera), ev)
+	} else {
+		log.Printf("%% Compare %s %s: %s vs %s\n", rt.model, rt.param.Candidate, prim.Class, cand.Class)
+	}
+	return serves
+}
+
+// entry returns the pending predictions of a frame, dropping those of frames
+// which waited too long. The lock must be held.
+func (rt *route) entry(key frameKey) *pending {
+	p, ok := rt.pending[key]
+	if ok {
+		return p
+	}
+	now := time.Now()
+	for k, old := range rt.pending {
+		if now.Sub(old.added) > pendingTimeout {
+			delete(rt.pending, k)
+		}
+	}
+	p = &pending{added: now}
+	rt.pending[key] = p
+	return p
+}
+
+// serving returns the pipeline of a model with the latest prediction for the
+// camera, the model's own or that of its canary
+func (mp *modelParam) serving(camera string) *modelParam {
+	if mp.route == nil || mp.route.canary == nil || mp.route.canary == mp {
+		return mp
+	}
+	cand, ok := mp.route.canary.outputs[camera]
+	if !ok {
+		return mp
+	}
+	prim, ok := mp.outputs[camera]
+	if ok && !cand.Time.After(prim.Time) {
+		return mp
+	}
+	return mp.route.canary
+}
+
+// counts reports whether the tracks of a pipeline feed the counters. When
+// frames are split, only the primary model's are counted, since the counters
+// expect all tracks of a camera from one tracker.
+func (mp *modelParam) counts() bool {
+	rt := mp.route
+	return rt == nil || rt.canary != mp || rt.param.By != "frame"
+}
+
+// time adds a measured latency, ignoring untimed initial predictions
+func (rt *route) time(ind int, latency time.Duration) {
+	if latency > 0 {
+		rt.latency[ind] += latency
+		rt.count[ind]++
+	}
+}
+
+func (rt *route) report() routeReport {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	rep := routeReport{
+		Candidate: rt.param.Candidate,
+		Mode:      rt.param.Mode,
+		Compared:  rt.compared,
+	}
+	if rt.param.Mode == "canary" {
+		rep.Percent = rt.param.Percent
+	}
+	if rt.compared > 0 {
+		rep.AgreementRate = float64(rt.agreed) / float64(rt.compared)
+	}
+	if rt.count[0] > 0 {
+		rep.PrimaryLatency = ms(rt.latency[0] / time.Duration(rt.count[0]))
+	}
+	if rt.count[1] > 0 {
+		rep.CandidateLatency = ms(rt.latency[1] / time.Duration(rt.count[1]))
+	}
+	rep.LatencyDelta = rep.CandidateLatency - rep.PrimaryLatency
+	return rep
+}
+
+// serveRoutes responds with the comparison report of every routed model
+func serveRoutes(w http.ResponseWriter, r *http.Request) {
+	reports := make(map[string]routeReport)
+	for _, mp := range modelParams {
+		if mp.route != nil {
+			reports[mp.modelName] = mp.route.report()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(reports)
+	if err != nil {
+		log.Println("Error in Encode:", err)
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"models"
+	"os"
+	"strconv"
+	"time"
+	"tracker"
+
+	"gocv.io/x/gocv"
+)
+
+var trackColor = color.RGBA{50, 150, 200, 0}
+
+// trackEvent is a track start or end event as published to Kafka
+type trackEvent struct {
+	Camera string `json:"camera"`
+	Model  string `json:"model"`
+	tracker.Event
+}
+
+// updateTracks feeds a new prediction into the tracker of its camera and
+// publishes the resulting track events
+func updateTracks(mp *modelParam, res models.Output, now time.Time) {
+	tr, ok := mp.trackers[res.Camera]
+	if !ok {
+		tr = tracker.New(*tracking)
+		mp.trackers[res.Camera] = tr
+	}
+
+	trackEvents := tr.Update(res.Detections, now)
+
+	// Count line crossings and zone occupancy
+	if c, ok := counters[res.Camera]; ok && c.Model() == mp.modelName && mp.counts() {
+		c.Update(tr.Tracks())
+	}
+
+	topic := os.Getenv("TOPICNAMETRACKS")
+	for _, ev := range trackEvents {
+		log.Printf("%% Track %s %s #%d %s\n", res.Camera, ev.Type, ev.ID, ev.Class)
+		if topic != "" {
+			publish(topic, []byte(res.Camera), trackEvent{
+				Camera: res.Camera,
+				Model:  mp.modelName,
+				Event:  ev,
+			})
+		}
+	}
+}
+
+// drawTracks draws the live tracks of a camera with their IDs and trails
+func drawTracks(frame *gocv.Mat, tr *tracker.Tracker) {
+	for _, t := range tr.Tracks() {
+		gocv.Rectangle(frame, t.Box, trackColor, 2)
+		gocv.PutText(
+			frame,
+			"#"+strconv.Itoa(t.ID)+" "+t.Class,
+			image.Pt(t.Box.Min.X, t.Box.Min.Y-5),
+			gocv.FontHersheyPlain, 1.2,
+			trackColor, 2,
+		)
+		if len(t.Trail) > 1 {
+			gocv.Polylines(frame, [][]image.Point{t.Trail}, false, trackColor, 1)
+		}
+	}
+}
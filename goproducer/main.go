@@ -16,6 +16,7 @@ func main() {
 
 	broker := os.Getenv("KAFKAPORT")
 	topic := os.Getenv("TOPICNAME")
+	camera := []byte(os.Getenv("CAMERAID"))
 	frameInterval, err := time.ParseDuration(os.Getenv("FRAMEINTERVAL"))
 	if err != nil {
 		log.Fatal("Invalid frame interval", err)
@@ -44,6 +45,7 @@ func main() {
 	// Stream images from RTSP to Kafka message queue
 	frame := gocv.NewMat()
 	errCount := 0
+	var seq uint64
 	for {
 		if !webcam.Read(&frame) {
 			errCount++
@@ -52,14 +54,18 @@ func main() {
 			}
 			continue
 		}
+		captured := time.Now()
+		seq++
 
 		//Form the struct to be sent to Kafka message queue
 		doc := topicMsg{
-			Mat:      frame.ToBytes(),
-			Channels: frame.Channels(),
-			Rows:     frame.Rows(),
-			Cols:     frame.Cols(),
-			Type:     frame.Type(),
+			Mat:       frame.ToBytes(),
+			Channels:  frame.Channels(),
+			Rows:      frame.Rows(),
+			Cols:      frame.Cols(),
+			Type:      frame.Type(),
+			Timestamp: captured,
+			Seq:       seq,
 		}
 
 		//Prepare message to be sent to Kafka
@@ -72,8 +78,9 @@ func main() {
 		//Send message into Kafka queue
 		p.ProduceChannel() <- &kafka.Message{
 			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Key:            camera,
 			Value:          docBytes,
-			Timestamp:      time.Now(),
+			Timestamp:      captured,
 		}
 
 		log.Printf("%% Message sent %v\n", time.Now())
@@ -89,11 +96,13 @@ func main() {
 
 //Result represents the Kafka queue message format
 type topicMsg struct {
-	Mat      []byte       `json:"mat"`
-	Channels int          `json:"channels"`
-	Rows     int          `json:"rows"`
-	Cols     int          `json:"cols"`
-	Type     gocv.MatType `json:"type"`
+	Mat       []byte       `json:"mat"`
+	Channels  int          `json:"channels"`
+	Rows      int          `json:"rows"`
+	Cols      int          `json:"cols"`
+	Type      gocv.MatType `json:"type"`
+	Timestamp time.Time    `json:"timestamp"` //Capture time of the frame
+	Seq       uint64       `json:"seq"`       //Frame number of the camera
 }
 
 func getenvint(str string) int {
@@ -0,0 +1,193 @@
+package main
+
+// dashboardHTML is the dashboard page, self-contained so that it works
+// without access to any CDN
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>govideo</title>
+<style>
+  * { box-sizing: border-box; }
+  body { margin: 0; font-family: sans-serif; background: #1e1e1e; color: #ddd; display: flex; height: 100vh; }
+  #grid { flex: 1; display: grid; grid-template-columns: repeat(auto-fill, minmax(320px, 1fr)); gap: 8px; padding: 8px; overflow-y: auto; align-content: start; }
+  #grid.expanded { grid-template-columns: 1fr; }
+  #grid.expanded .cam:not(.selected) { display: none; }
+  .cam { background: #000; border: 2px solid #333; cursor: pointer; position: relative; }
+  .cam.selected { border-color: #c89632; }
+  .cam img { width: 100%; display: block; }
+  .cam .name { position: absolute; top: 0; left: 0; padding: 2px 6px; background: rgba(0,0,0,.6); font-size: 13px; }
+  #panel { width: 340px; overflow-y: auto; background: #262626; padding: 8px; border-left: 1px solid #333; }
+  #panel h2 { font-size: 15px; margin: 12px 0 4px; color: #c89632; }
+  #panel h3 { font-size: 12px; margin: 6px 0 2px; color: #999; text-transform: uppercase; }
+  #panel table { width: 100%; font-size: 13px; border-collapse: collapse; }
+  #panel td { padding: 1px 4px; }
+  #panel td.num { text-align: right; }
+  .alert { font-size: 12px; color: #f66; }
+  #status { font-size: 12px; color: #999; }
+</style>
+</head>
+<body>
+<div id="grid"></div>
+<div id="panel"><div id="status">Connecting...</div><div id="cameras"></div></div>
+<script>
+(function () {
+  "use strict";
+  var grid = document.getElementById("grid");
+  var panels = {};
+  var selected = null;
+  var pending = false;
+
+  function el(tag, text, cls) {
+    var e = document.createElement(tag);
+    if (text !== undefined) { e.textContent = text; }
+    if (cls) { e.className = cls; }
+    return e;
+  }
+
+  // Camera grid, refreshed from the cameras listing
+  function refreshGrid() {
+    fetch("/cameras").then(function (res) { return res.json(); }).then(function (list) {
+      var ids = {};
+      list.forEach(function (cam) {
+        ids[cam.id] = true;
+        if (document.getElementById("cam-" + cam.id)) { return; }
+        var div = el("div", undefined, "cam");
+        div.id = "cam-" + cam.id;
+        var img = el("img");
+        img.src = cam.stream;
+        img.alt = cam.id;
+        div.appendChild(img);
+        div.appendChild(el("span", cam.id, "name"));
+        div.onclick = function () { toggle(cam.id); };
+        grid.appendChild(div);
+      });
+      Array.prototype.slice.call(grid.children).forEach(function (div) {
+        if (!ids[div.id.slice(4)]) { grid.removeChild(div); }
+      });
+    }).catch(function () {});
+  }
+
+  // Expand a camera to the full grid, or go back to all cameras
+  function toggle(id) {
+    var prev = document.getElementById("cam-" + selected);
+    if (prev) { prev.classList.remove("selected"); }
+    selected = selected === id ? null : id;
+    grid.classList.toggle("expanded", selected !== null);
+    var cur = document.getElementById("cam-" + selected);
+    if (cur) { cur.classList.add("selected"); }
+    render();
+  }
+
+  function panel(camera) {
+    if (!panels[camera]) { panels[camera] = { predictions: {}, counts: null, alerts: [] }; }
+    return panels[camera];
+  }
+
+  function pct(score) { return (100 * score).toFixed(1) + "%"; }
+
+  // Render at most once per animation frame however fast events arrive
+  function schedule() {
+    if (pending) { return; }
+    pending = true;
+    requestAnimationFrame(function () { pending = false; render(); });
+  }
+
+  // Side panel with the predictions, counts and alerts of each camera
+  function render() {
+    var root = document.getElementById("cameras");
+    root.innerHTML = "";
+    Object.keys(panels).sort().forEach(function (camera) {
+      if (selected !== null && camera !== selected) { return; }
+      var p = panels[camera];
+      root.appendChild(el("h2", camera));
+
+      var models = Object.keys(p.predictions).sort();
+      if (models.length) {
+        root.appendChild(el("h3", "Predictions"));
+        var t = el("table");
+        models.forEach(function (model) {
+          var pred = p.predictions[model];
+          var tr = el("tr");
+          tr.appendChild(el("td", model));
+          tr.appendChild(el("td", pred.class));
+          tr.appendChild(el("td", pred.score ? pct(pred.score) : "", "num"));
+          t.appendChild(tr);
+          (pred.detections || []).forEach(function (d) {
+            var dr = el("tr");
+            dr.appendChild(el("td", ""));
+            dr.appendChild(el("td", (d.Region ? d.Region + " " : "") + d.Class));
+            dr.appendChild(el("td", pct(d.Score), "num"));
+            t.appendChild(dr);
+          });
+        });
+        root.appendChild(t);
+      }
+
+      if (p.counts) {
+        root.appendChild(el("h3", "Counts"));
+        var c = el("table");
+        Object.keys(p.counts.lines || {}).sort().forEach(function (line) {
+          var byClass = p.counts.lines[line];
+          Object.keys(byClass).sort().forEach(function (cls) {
+            var tr = el("tr");
+            tr.appendChild(el("td", line));
+            tr.appendChild(el("td", cls));
+            tr.appendChild(el("td", "in " + byClass[cls].in + " / out " + byClass[cls].out, "num"));
+            c.appendChild(tr);
+          });
+        });
+        Object.keys(p.counts.zones || {}).sort().forEach(function (zone) {
+          var byClass = p.counts.zones[zone];
+          Object.keys(byClass).sort().forEach(function (cls) {
+            var tr = el("tr");
+            tr.appendChild(el("td", zone));
+            tr.appendChild(el("td", cls));
+            tr.appendChild(el("td", "now " + byClass[cls].occupancy, "num"));
+            c.appendChild(tr);
+          });
+        });
+        root.appendChild(c);
+      }
+
+      if (p.alerts.length) {
+        root.appendChild(el("h3", "Alerts"));
+        p.alerts.slice().reverse().forEach(function (a) {
+          var when = new Date(a.time).toLocaleTimeString();
+          root.appendChild(el("div", when + " " + a.rule + ": " + a.class + " " + pct(a.score), "alert"));
+        });
+      }
+    });
+  }
+
+  // Live events from govideo
+  var status = document.getElementById("status");
+  var source = new EventSource("/events");
+  source.onopen = function () { status.textContent = "Live"; };
+  source.onerror = function () { status.textContent = "Reconnecting..."; };
+  source.addEventListener("prediction", function (e) {
+    var msg = JSON.parse(e.data);
+    panel(msg.camera).predictions[msg.event.model] = msg.event;
+    schedule();
+  });
+  source.addEventListener("counts", function (e) {
+    var msg = JSON.parse(e.data);
+    panel(msg.camera).counts = msg.event;
+    schedule();
+  });
+  source.addEventListener("alert", function (e) {
+    var msg = JSON.parse(e.data);
+    var alerts = panel(msg.camera).alerts;
+    alerts.push(msg.event);
+    if (alerts.length > 10) { alerts.shift(); }
+    schedule();
+  });
+
+  refreshGrid();
+  setInterval(refreshGrid, 5000);
+})();
+</script>
+</body>
+</html>
+`
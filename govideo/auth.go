@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" //RS384 and RS512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Time basic credentials are trusted after a successful bcrypt comparison
+const basicCache = 5 * time.Minute
+
+// Clock skew tolerated on JWT expiry and not-before times
+const jwtLeeway = time.Minute
+
+// authParam configures authentication and per-camera authorization
+type authParam struct {
+	Tokens      string     `json:"tokens"`      //File of user:token lines for bearer tokens
+	Htpasswd    string     `json:"htpasswd"`    //File of user:bcrypt-hash lines for basic auth
+	JWKS        string     `json:"jwks"`        //JWKS file to verify OIDC JWTs with
+	Issuer      string     `json:"issuer"`      //Required iss of JWTs, if set
+	Audience    string     `json:"audience"`    //Required aud of JWTs, if set
+	UserClaim   string     `json:"userclaim"`   //JWT claim naming the user, "sub" by default
+	GroupsClaim string     `json:"groupsclaim"` //JWT claim listing the groups, "groups" by default
+	Rules       []authRule `json:"rules"`       //Cameras each user may view, all if empty
+	Audit       string     `json:"audit"`       //File of the audit log, the standard log if empty
+}
+
+// authRule grants users and groups access to cameras. "*" matches any user
+// or camera.
+type authRule struct {
+	Users   []string `json:"users"`
+	Groups  []string `json:"groups"`
+	Cameras []string `json:"cameras"`
+}
+
+// identity is an authenticated user
+type identity struct {
+	User   string
+	Groups []string
+	Method string //"bearer", "basic" or "jwt"
+}
+
+// auditEntry records a request in the audit log
+type auditEntry struct {
+	Time     time.Time `json:"time"` //Start of the request
+	User     string    `json:"user,omitempty"`
+	Method   string    `json:"method,omitempty"` //Authentication method
+	Remote   string    `json:"remote"`
+	Path     string    `json:"path"`
+	Camera   string    `json:"camera,omitempty"`
+	Allowed  bool      `json:"allowed"`
+	Status   int       `json:"status"`
+	Duration float64   `json:"duration"` //Seconds, the viewing time of streams
+}
+
+// authenticator checks the credentials of requests and whether users may
+// view cameras
+type authenticator struct {
+	param    authParam
+	tokens   map[[sha256.Size]byte]string //Hashed bearer token to user
+	hashes   map[string][]byte            //User to bcrypt hash
+	dummy    []byte                       //Hash compared for unknown users, so they take as long as known ones
+	jwks     *jwks
+	lock     sync.Mutex
+	verified map[[sha256.Size]byte]time.Time //Hashed basic credentials to expiry
+	audit    io.Writer
+	auditMu  sync.Mutex
+}
+
+// Authenticator of the server, nil without authentication
+var auth *authenticator
+
+type identityKey struct{}
+
+// newAuthenticator loads the credential files of param
+func newAuthenticator(param authParam) (*authenticator, error) {
+	if param.Tokens == "" && param.Htpasswd == "" && param.JWKS == "" {
+		return nil, errors.New("auth needs tokens, htpasswd or jwks")
+	}
+	if param.UserClaim == "" {
+		param.UserClaim = "sub"
+	}
+	if param.GroupsClaim == "" {
+		param.GroupsClaim = "groups"
+	}
+	a := &authenticator{
+		param:    param,
+		tokens:   make(map[[sha256.Size]byte]string),
+		hashes:   make(map[string][]byte),
+		verified: make(map[[sha256.Size]byte]time.Time),
+		audit:    os.Stdout,
+	}
+
+	if param.Tokens != "" {
+		err := readUserFile(param.Tokens, func(user, token string) {
+			a.tokens[sha256.Sum256([]byte(token))] = user
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if param.Htpasswd != "" {
+		cost := bcrypt.DefaultCost
+		err := readUserFile(param.Htpasswd, func(user, hash string) {
+			a.hashes[user] = []byte(hash)
+			if c, err := bcrypt.Cost([]byte(hash)); err == nil {
+				cost = c
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		a.dummy, err = bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+		if err != nil {
+			return nil, errors.New("Failed to hash dummy password. " + err.Error())
+		}
+	}
+	if param.JWKS != "" {
+		a.jwks = &jwks{file: param.JWKS}
+		err := a.jwks.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if param.Audit != "" {
+		f, err := os.OpenFile(param.Audit, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, errors.New("Failed to open audit log. " + err.Error())
+		}
+		a.audit = f
+	}
+	return a, nil
+}
+
+// readUserFile calls add with each user:secret line of a file, skipping
+// blank lines and # comments
+func readUserFile(file string, add func(user, secret string)) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.New("Failed to read " + file + ". " + err.Error())
+	}
+	for ii, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return errors.New("Invalid line " + strconv.Itoa(ii+1) + " in " + file)
+		}
+		add(kv[0], kv[1])
+	}
+	return nil
+}
+
+// identify returns the user of a request, from a bearer token in the
+// Authorization header or access_token parameter, or from basic credentials
+func (a *authenticator) identify(r *http.Request) (*identity, error) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		return a.basic(user, pass)
+	}
+	token := r.URL.Query().Get("access_token")
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		token = strings.TrimSpace(h[7:])
+	}
+	if token == "" {
+		return nil, errors.New("no credentials")
+	}
+	if user, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+		return &identity{User: user, Method: "bearer"}, nil
+	}
+	if a.jwks != nil && strings.Count(token, ".") == 2 {
+		return a.jwt(token)
+	}
+	return nil, errors.New("unknown token")
+}
+
+// basic checks basic credentials against the htpasswd file
+func (a *authenticator) basic(user, pass string) (*identity, error) {
+	hash, ok := a.hashes[user]
+	if !ok {
+		if a.dummy != nil {
+			bcrypt.CompareHashAndPassword(a.dummy, []byte(pass))
+		}
+		return nil, errors.New("unknown user " + user)
+	}
+	key := sha256.Sum256([]byte(user + ":" + pass))
+	a.lock.Lock()
+	expiry, ok := a.verified[key]
+	a.lock.Unlock()
+	if !ok || time.Now().After(expiry) {
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(pass)); err != nil {
+			return nil, errors.New("wrong password for " + user)
+		}
+		a.lock.Lock()
+		for k, exp := range a.verified {
+			if time.Now().After(exp) {
+				delete(a.verified, k)
+			}
+		}
+		a.verified[key] = time.Now().Add(basicCache)
+		a.lock.Unlock()
+	}
+	return &identity{User: user, Method: "basic"}, nil
+}
+
+// jwt verifies the signature and claims of a JWT
+func (a *authenticator) jwt(token string) (*identity, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("invalid jwt header. " + err.Error())
+	}
+	hash, ok := map[string]crypto.Hash{
+		"RS256": crypto.SHA256,
+		"RS384": crypto.SHA384,
+		"RS512": crypto.SHA512,
+	}[header.Alg]
+	if !ok {
+		return nil, errors.New("unsupported jwt alg " + header.Alg)
+	}
+	key, err := a.jwks.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid jwt signature encoding")
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig); err != nil {
+		return nil, errors.New("invalid jwt signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("invalid jwt claims. " + err.Error())
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("jwt expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("jwt not valid yet")
+	}
+	if a.param.Issuer != "" && claims["iss"] != a.param.Issuer {
+		return nil, errors.New("wrong jwt issuer")
+	}
+	if a.param.Audience != "" && !contains(claimStrings(claims["aud"]), a.param.Audience) {
+		return nil, errors.New("wrong jwt audience")
+	}
+	user, _ := claims[a.param.UserClaim].(string)
+	if user == "" {
+		return nil, errors.New("jwt without " + a.param.UserClaim)
+	}
+	return &identity{User: user, Groups: claimStrings(claims[a.param.GroupsClaim]), Method: "jwt"}, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings returns a claim holding a string or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jwks holds the RSA keys of a JWKS file, reloading the file when a key is
+// not found and the file changed, so that rotated keys are picked up
+type jwks struct {
+	file     string
+	lock     sync.Mutex
+	modified time.Time
+	keys     map[string]*rsa.PublicKey
+}
+
+func (k *jwks) load() error {
+	info, err := os.Stat(k.file)
+	if err != nil {
+		return errors.New("Failed to read jwks. " + err.Error())
+	}
+	data, err := ioutil.ReadFile(k.file)
+	if err != nil {
+		return errors.New("Failed to read jwks. " + err.Error())
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return errors.New("Invalid jwks. " + err.Error())
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return errors.New("Invalid jwks key " + jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("Invalid jwks. No RSA signing keys")
+	}
+	k.keys = keys
+	k.modified = info.ModTime()
+	return nil
+}
+
+// key returns the key of a kid, or the only key for tokens without a kid
+func (k *jwks) key(kid string) (*rsa.PublicKey, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	find := func() *rsa.PublicKey {
+		if kid == "" && len(k.keys) == 1 {
+			for _, key := range k.keys {
+				return key
+			}
+		}
+		return k.keys[kid]
+	}
+	if key := find(); key != nil {
+		return key, nil
+	}
+	if info, err := os.Stat(k.file); err == nil && info.ModTime() != k.modified {
+		if err := k.load(); err != nil {
+			log.Println("Auth:", err)
+		}
+		if key := find(); key != nil {
+			return key, nil
+		}
+	}
+	return nil, errors.New("unknown jwt key " + kid)
+}
+
+// allowed reports whether a user may view a camera
+func (a *authenticator) allowed(id *identity, camera string) bool {
+	return a.allow(id, func(c string) bool { return c == camera })
+}
+
+// allowedClip reports whether a user may view a clip of a camera, as named
+// by the clip's sidecar. Clips of no known camera need access to all cameras.
+func (a *authenticator) allowedClip(id *identity, camera string) bool {
+	return a.allow(id, func(c string) bool { return camera != "" && c == camera })
+}
+
+// allow reports whether a rule grants a user a camera matched by match
+func (a *authenticator) allow(id *identity, match func(camera string) bool) bool {
+	if len(a.param.Rules) == 0 {
+		return true
+	}
+	for _, rule := range a.param.Rules {
+		user := contains(rule.Users, "*") || contains(rule.Users, id.User)
+		for _, g := range id.Groups {
+			user = user || contains(rule.Groups, g)
+		}
+		if !user {
+			continue
+		}
+		for _, c := range rule.Cameras {
+			if c == "*" || match(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wrap authenticates the requests to next, refusing users the camera of
+// the request, and audits them
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := auditEntry{
+			Time:   time.Now(),
+			Remote: r.RemoteAddr,
+			Path:   r.URL.Path,
+		}
+		defer func() {
+			entry.Duration = time.Since(entry.Time).Seconds()
+			a.log(entry)
+		}()
+
+		id, err := a.identify(r)
+		if err != nil {
+			log.Println("Auth:", r.RemoteAddr, err)
+			if a.param.Htpasswd != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="govideo"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="govideo"`)
+			}
+			entry.Status = http.StatusUnauthorized
+			http.Error(w, "Unauthorized", entry.Status)
+			return
+		}
+		entry.User, entry.Method = id.User, id.Method
+
+		// Check the camera of camera resources and clip downloads
+		allowed := true
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/cameras/"):
+			entry.Camera = strings.SplitN(strings.TrimPrefix(r.URL.Path, "/cameras/"), "/", 2)[0]
+			allowed = a.allowed(id, entry.Camera)
+		case strings.HasPrefix(r.URL.Path, "/clips/"):
+			file := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/clips/"), "/", 2)[0]
+			entry.Camera = clipCamera(clipName(file))
+			allowed = a.allowedClip(id, entry.Camera)
+		}
+		if !allowed {
+			entry.Status = http.StatusForbidden
+			http.Error(w, "Forbidden", entry.Status)
+			return
+		}
+		entry.Allowed = true
+
+		aw := &auditWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+		entry.Status = aw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+	})
+}
+
+// log writes an entry to the audit log
+func (a *authenticator) log(entry auditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Error in Marshal:", err)
+		return
+	}
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+	_, err = a.audit.Write(append(data, '\n'))
+	if err != nil {
+		log.Println("Failed to write audit log", err)
+	}
+}
+
+// allowedCamera reports whether the user of a request may view a camera,
+// always true without authentication
+func allowedCamera(r *http.Request, camera string) bool {
+	if auth == nil {
+		return true
+	}
+	id, ok := r.Context().Value(identityKey{}).(*identity)
+	return ok && auth.allowed(id, camera)
+}
+
+// allowedClip reports whether the user of a request may view a clip, always
+// true without authentication
+func allowedClip(r *http.Request, clip string) bool {
+	if auth == nil {
+		return true
+	}
+	id, ok := r.Context().Value(identityKey{}).(*identity)
+	return ok && auth.allowedClip(id, clipCamera(clip))
+}
+
+// auditWriter records the status of a response, keeping the streaming and
+// hijacking abilities of the underlying writer
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *auditWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tempFile writes data to a file in dir
+func tempFile(t *testing.T, dir, name, data string) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestBasic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	htpasswd := tempFile(t, dir, "htpasswd", "# users\n\nalice:"+string(hash)+"\n")
+
+	a, err := newAuthenticator(authParam{Htpasswd: htpasswd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		user, pass string
+		ok         bool
+	}{
+		{"right password", "alice", "secret", true},
+		{"cached", "alice", "secret", true},
+		{"wrong password", "alice", "guess", false},
+		{"unknown user", "bob", "secret", false},
+	}
+	for _, tt := range tests {
+		id, err := a.basic(tt.user, tt.pass)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if tt.ok && (id.User != tt.user || id.Method != "basic") {
+			t.Errorf("%s: identity %+v", tt.name, id)
+		}
+	}
+
+	//Unknown users are compared against a dummy hash of the same cost
+	if cost, err := bcrypt.Cost(a.dummy); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("dummy hash cost %d %v, want %d", cost, err, bcrypt.MinCost)
+	}
+
+	//Expired verifications are compared again
+	key := sha256.Sum256([]byte("alice:secret"))
+	if _, ok := a.verified[key]; !ok {
+		t.Fatal("verified credentials not cached")
+	}
+	a.verified[key] = time.Now().Add(-time.Second)
+	a.hashes["alice"], _ = bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+	if _, err := a.basic("alice", "secret"); err == nil {
+		t.Error("expired verification accepted an old password")
+	}
+
+	if _, err := newAuthenticator(authParam{Htpasswd: tempFile(t, dir, "bad", "alice\n")}); err == nil {
+		t.Error("invalid htpasswd line accepted")
+	}
+}
+
+// signer issues RS256 JWTs with a key of a JWKS file
+type signer struct {
+	key *rsa.PrivateKey
+	kid string
+}
+
+func (s signer) jwk() map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": s.kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}
+}
+
+func (s signer) sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": s.kid})
+	payload, _ := json.Marshal(claims)
+	token := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(token))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newSigner(t *testing.T, kid string) signer {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer{key, kid}
+}
+
+func writeJWKS(t *testing.T, file string, signers ...signer) {
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, other := newSigner(t, "a"), newSigner(t, "b")
+	file := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, file, s)
+
+	a, err := newAuthenticator(authParam{JWKS: file, Issuer: "https://idp", Audience: "video"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	claims := func(change map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://idp",
+			"aud":    []string{"other", "video"},
+			"sub":    "alice",
+			"groups": []string{"ops", "security"},
+			"exp":    now + 60,
+		}
+		for k, v := range change {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	valid := s.sign(t, "RS256", claims(nil))
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"single audience", s.sign(t, "RS256", claims(map[string]interface{}{"aud": "video"})), true},
+		{"expired within leeway", s.sign(t, "RS256", claims(map[string]interface{}{"exp": now - 30})), true},
+		{"expired", s.sign(t, "RS256", claims(map[string]interface{}{"exp": now - 120})), false},
+		{"no expiry", s.sign(t, "RS256", claims(map[string]interface{}{"exp": nil})), false},
+		{"not valid yet", s.sign(t, "RS256", claims(map[string]interface{}{"nbf": now + 120})), false},
+		{"wrong issuer", s.sign(t, "RS256", claims(map[string]interface{}{"iss": "https://evil"})), false},
+		{"wrong audience", s.sign(t, "RS256", claims(map[string]interface{}{"aud": "other"})), false},
+		{"no user", s.sign(t, "RS256", claims(map[string]interface{}{"sub": nil})), false},
+		{"unsupported alg", s.sign(t, "HS256", claims(nil)), false},
+		{"unknown key", other.sign(t, "RS256", claims(nil)), false},
+		{"tampered", valid[:len(valid)-4] + "AAAA", false},
+	}
+	for _, tt := range tests {
+		_, err := a.jwt(tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+	}
+
+	id, _ := a.jwt(valid)
+	if id.User != "alice" || id.Method != "jwt" || len(id.Groups) != 2 || id.Groups[1] != "security" {
+		t.Errorf("identity %+v", id)
+	}
+
+	//Rotated keys are picked up when the file changes
+	writeJWKS(t, file, s, other)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(file, later, later)
+	if _, err := a.jwt(other.sign(t, "RS256", claims(nil))); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+}
+
+func TestAllowedClip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clips")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { clipsDir = old }(clipsDir)
+	clipsDir = dir
+
+	//Both cameras record clips named lobby-1_...
+	tempFile(t, dir, "lobby-1_20200101T000000.000.json", `{"camera":"lobby/1"}`)
+	tempFile(t, dir, "lobby-1_20200101T000001.000.json", `{"camera":"lobby-1"}`)
+	a := &authenticator{param: authParam{Rules: []authRule{
+		{Users: []string{"alice"}, Cameras: []string{"lobby/1"}},
+		{Users: []string{"root"}, Cameras: []string{"*"}},
+	}}}
+	alice, root := &identity{User: "alice"}, &identity{User: "root"}
+
+	tests := []struct {
+		file   string
+		camera string
+		alice  bool
+		root   bool
+	}{
+		{"lobby-1_20200101T000000.000.mp4", "lobby/1", true, true},
+		{"lobby-1_20200101T000000.000.json", "lobby/1", true, true},
+		{"lobby-1_20200101T000000.000", "lobby/1", true, true},
+		{"lobby-1_20200101T000001.000.mp4", "lobby-1", false, true},
+		{"lobby-1_20200101T000002.000.mp4", "", false, true},
+		{"lobby-1.mp4", "", false, true},
+		{"", "", false, true},
+	}
+	for _, tt := range tests {
+		camera := clipCamera(clipName(tt.file))
+		if camera != tt.camera {
+			t.Errorf("%s: camera %q, want %q", tt.file, camera, tt.camera)
+		}
+		if a.allowedClip(alice, camera) != tt.alice || a.allowedClip(root, camera) != tt.root {
+			t.Errorf("%s: alice %v root %v", tt.file, a.allowedClip(alice, camera), a.allowedClip(root, camera))
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"mjpeg"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Camera used for frames without a camera ID
+const defaultCamera = "default"
+
+// camera is the live feed of one camera
+type camera struct {
+	id     string
+	stream *mjpeg.Stream
+	hls    *hlsSegmenter //Nil without HLS output
+	last   time.Time     //Time the latest frame arrived
+
+	// Held while pushing a frame, so that a camera is not closed midway
+	lock   sync.Mutex
+	closed bool
+}
+
+// cameraInfo describes a camera in the cameras listing
+type cameraInfo struct {
+	ID       string    `json:"id"`
+	Stream   string    `json:"stream"`
+	Snapshot string    `json:"snapshot"`
+	WS       string    `json:"ws"`
+	HLS      string    `json:"hls,omitempty"`
+	Last     time.Time `json:"last"`
+}
+
+var (
+	cameras     = make(map[string]*camera)
+	camerasLock sync.Mutex
+)
+
+// cameraID returns the camera a message came from, given by the message key
+// or else a "camera" header
+func cameraID(ev *kafka.Message) string {
+	if len(ev.Key) > 0 {
+		return string(ev.Key)
+	}
+	for _, h := range ev.Headers {
+		if h.Key == "camera" && len(h.Value) > 0 {
+			return string(h.Value)
+		}
+	}
+	return defaultCamera
+}
+
+// updateCamera pushes a frame to the stream of a camera, creating the
+// camera on its first frame
+func updateCamera(id string, jpeg []byte, captured time.Time, seq uint64) {
+	for {
+		cam := liveCamera(id)
+		cam.lock.Lock()
+		if !cam.closed {
+			cam.stream.UpdateFrame(jpeg, captured, seq)
+			if cam.hls != nil {
+				cam.hls.add(jpeg)
+			}
+			cam.lock.Unlock()
+			return
+		}
+		// Removed since it was looked up, the next lookup creates it again
+		cam.lock.Unlock()
+	}
+}
+
+// liveCamera returns a camera, creating it if needed, and marks it as
+// receiving a frame
+func liveCamera(id string) *camera {
+	camerasLock.Lock()
+	defer camerasLock.Unlock()
+	cam, ok := cameras[id]
+	if !ok {
+		log.Println("Camera", id, "appeared")
+		cam = &camera{id: id, stream: mjpeg.NewStream(frameInterval)}
+		cam.stream.Transcode = resizeJPEG
+		cam.stream.FrameHeaders = frameHeaders
+		if hls != nil {
+			var err error
+			cam.hls, err = newHLSSegmenter(id, *hls)
+			if err != nil {
+				log.Println("Camera", id, "without HLS:", err)
+			}
+		}
+		cameras[id] = cam
+	}
+	cam.last = time.Now()
+	return cam
+}
+
+// close disconnects the clients of a camera, waiting for a frame being
+// pushed
+func (cam *camera) close() {
+	cam.lock.Lock()
+	defer cam.lock.Unlock()
+	cam.closed = true
+	cam.stream.Close()
+	if cam.hls != nil {
+		cam.hls.close()
+	}
+}
+
+// getCamera returns a live camera
+func getCamera(id string) (*camera, bool) {
+	camerasLock.Lock()
+	defer camerasLock.Unlock()
+	cam, ok := cameras[id]
+	return cam, ok
+}
+
+// gcCameras removes cameras which sent no frame for longer than idle,
+// disconnecting their clients
+func gcCameras(idle time.Duration) {
+	for range time.Tick(idle / 2) {
+		camerasLock.Lock()
+		for id, cam := range cameras {
+			if time.Since(cam.last) > idle {
+				log.Println("Camera", id, "idle, removing")
+				cam.close()
+				delete(cameras, id)
+			}
+		}
+		camerasLock.Unlock()
+	}
+}
+
+// closeCameras removes all cameras, disconnecting their clients
+func closeCameras() {
+	camerasLock.Lock()
+	defer camerasLock.Unlock()
+	for id, cam := range cameras {
+		cam.close()
+		delete(cameras, id)
+	}
+}
+
+// serveCameras responds with the live cameras, sorted by ID
+func serveCameras(w http.ResponseWriter, r *http.Request) {
+	camerasLock.Lock()
+	list := make([]cameraInfo, 0, len(cameras))
+	for id, cam := range cameras {
+		if !allowedCamera(r, id) {
+			continue
+		}
+		info := cameraInfo{
+			ID:       id,
+			Stream:   "/cameras/" + id + "/stream",
+			Snapshot: "/cameras/" + id + "/snapshot.jpg",
+			WS:       "/cameras/" + id + "/ws",
+			Last:     cam.last,
+		}
+		if cam.hls != nil {
+			info.HLS = "/cameras/" + id + "/hls/index.m3u8"
+		}
+		list = append(list, info)
+	}
+	camerasLock.Unlock()
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		log.Println("Error in Encode:", err)
+	}
+}
+
+// serveCamera routes /cameras/{id}/{resource} to the camera's resource
+func serveCamera(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/cameras/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || len(parts) == 3 && parts[1] != "hls" {
+		http.NotFound(w, r)
+		return
+	}
+	// Replays do not need the camera to be live
+	if parts[1] == "stream" && r.URL.Query().Get("from") != "" {
+		serveReplay(w, r, parts[0])
+		return
+	}
+	cam, ok := getCamera(parts[0])
+	if !ok {
+		http.Error(w, "Unknown camera "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "stream":
+		cam.stream.ServeHTTP(w, r)
+	case "snapshot.jpg":
+		serveSnapshot(w, r, cam)
+	case "ws":
+		serveWebSocket(w, r, cam)
+	case "hls":
+		if len(parts) != 3 {
+			http.NotFound(w, r)
+			return
+		}
+		serveHLS(w, r, cam, parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleCameras registers the cameras listing at /cameras and the camera
+// resources under /cameras/
+func handleCameras() {
+	http.HandleFunc("/cameras", serveCameras)
+	http.HandleFunc("/cameras/", serveCamera)
+}
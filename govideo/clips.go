@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// clipInfo describes a recorded clip in the clips listing
+type clipInfo struct {
+	Name     string    `json:"name"`
+	URL      string    `json:"url"`
+	Sidecar  string    `json:"sidecar"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Directory of the recorded clips, empty when clips are not served
+var clipsDir string
+
+// Time in clip names, which are camera_time with slashes in the camera
+// replaced by dashes
+const clipTimeLayout = "20060102T150405.000"
+
+// clipName returns the clip a file in the clips dir belongs to, its video,
+// sidecar or directory of frames, or "" for other files
+func clipName(file string) string {
+	ii := strings.LastIndex(file, "_")
+	if ii < 0 || len(file) < ii+1+len(clipTimeLayout) {
+		return ""
+	}
+	name := file[:ii+1+len(clipTimeLayout)]
+	if _, err := time.Parse(clipTimeLayout, name[ii+1:]); err != nil {
+		return ""
+	}
+	return name
+}
+
+// clipCamera returns the camera ID recorded in the sidecar of a clip, or ""
+// without a sidecar. The clip name does not tell it, as distinct cameras may
+// have the same name once slashes are replaced.
+func clipCamera(clip string) string {
+	if clip == "" || clipsDir == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(filepath.Join(clipsDir, clip+".json"))
+	if err != nil {
+		return ""
+	}
+	var sidecar struct {
+		Camera string `json:"camera"`
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		log.Println("Invalid clip sidecar", clip, err)
+		return ""
+	}
+	return sidecar.Camera
+}
+
+// serveClips responds with the clips recorded in dir, newest first
+func serveClips(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Println("Failed to read clips dir", err)
+			http.Error(w, "Failed to read clips", http.StatusInternalServerError)
+			return
+		}
+
+		names := make(map[string]bool)
+		for _, f := range files {
+			names[f.Name()] = true
+		}
+
+		// The sidecar is written last, so clips without one are incomplete
+		list := []clipInfo{}
+		for _, f := range files {
+			name := f.Name()
+			base := strings.TrimSuffix(name, filepath.Ext(name))
+			if f.IsDir() {
+				base = name
+			}
+			if strings.HasSuffix(name, ".json") || !names[base+".json"] || !allowedClip(r, base) {
+				continue
+			}
+			info := clipInfo{
+				Name:     base,
+				URL:      "/clips/" + name,
+				Sidecar:  "/clips/" + base + ".json",
+				Size:     f.Size(),
+				Modified: f.ModTime(),
+			}
+			if f.IsDir() {
+				info.URL += "/"
+			}
+			list = append(list, info)
+		}
+		sort.Slice(list, func(a, b int) bool { return list[a].Modified.After(list[b].Modified) })
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(list)
+		if err != nil {
+			log.Println("Error in Encode:", err)
+		}
+	}
+}
+
+// handleClips registers the clips listing at /clips and downloads under
+// /clips/ when CLIPSDIR is set
+func handleClips() {
+	dir, ok := os.LookupEnv("CLIPSDIR")
+	if !ok {
+		return
+	}
+	clipsDir = dir
+	http.HandleFunc("/clips", serveClips(dir))
+	http.Handle("/clips/", http.StripPrefix("/clips/", http.FileServer(http.Dir(dir))))
+}
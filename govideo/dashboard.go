@@ -0,0 +1,292 @@
+package main
+
+import (
+	"confluentkafkago"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Number of recent alerts kept per camera
+const recentAlerts = 10
+
+// Interval of keep-alive comments on idle event streams
+const heartbeat = 15 * time.Second
+
+// Number of recent frames per camera whose predictions are kept, to pair
+// them with the frames sent over WebSockets
+const framePredictions = 64
+
+// panelEvent is a prediction, counts or alert of a camera, sent to the
+// dashboard as a server-sent event
+type panelEvent struct {
+	Type   string          //"prediction", "counts" or "alert"
+	Camera string          //Camera the event belongs to
+	Data   json.RawMessage //Event as published by goconsumer
+	Model  string          //Model of a prediction
+	Time   time.Time       //Capture time of the frame of a prediction
+}
+
+// panel is the latest state of a camera shown in the side panel
+type panel struct {
+	predictions map[string]panelEvent //Latest prediction per model
+	counts      *panelEvent
+	alerts      []panelEvent //Most recent last
+
+	// Predictions of recent frames by capture time, oldest first
+	frames map[int64][]panelEvent
+	times  []int64
+}
+
+// hub keeps the panel of each camera and fans events out to the dashboard
+// clients
+type hub struct {
+	lock    sync.Mutex
+	panels  map[string]*panel
+	clients map[chan panelEvent]bool
+}
+
+var dashboard = &hub{
+	panels:  make(map[string]*panel),
+	clients: make(map[chan panelEvent]bool),
+}
+
+// publish records an event and pushes it to the clients, dropping it for
+// clients which are not keeping up
+func (h *hub) publish(ev panelEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	p, ok := h.panels[ev.Camera]
+	if !ok {
+		p = &panel{
+			predictions: make(map[string]panelEvent),
+			frames:      make(map[int64][]panelEvent),
+		}
+		h.panels[ev.Camera] = p
+	}
+	switch ev.Type {
+	case "prediction":
+		var pred struct {
+			Model string    `json:"model"`
+			Time  time.Time `json:"time"`
+		}
+		if err := json.Unmarshal(ev.Data, &pred); err != nil {
+			log.Println("Invalid prediction:", err)
+			return
+		}
+		ev.Model, ev.Time = pred.Model, pred.Time
+		p.predictions[pred.Model] = ev
+		p.addFrame(ev)
+	case "counts":
+		p.counts = &ev
+	case "alert":
+		p.alerts = append(p.alerts, ev)
+		if len(p.alerts) > recentAlerts {
+			p.alerts = p.alerts[len(p.alerts)-recentAlerts:]
+		}
+	}
+
+	for c := range h.clients {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel of new events, preceded by the current state
+// of all panels
+func (h *hub) subscribe() chan panelEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var state []panelEvent
+	for _, p := range h.panels {
+		for _, ev := range p.predictions {
+			state = append(state, ev)
+		}
+		if p.counts != nil {
+			state = append(state, *p.counts)
+		}
+		state = append(state, p.alerts...)
+	}
+	c := make(chan panelEvent, len(state)+64)
+	for _, ev := range state {
+		c <- ev
+	}
+	h.clients[c] = true
+	return c
+}
+
+// addFrame keeps a prediction with the others of its frame, forgetting the
+// oldest frame when too many are kept
+func (p *panel) addFrame(ev panelEvent) {
+	if ev.Time.IsZero() {
+		return
+	}
+	key := ev.Time.UnixNano()
+	preds, ok := p.frames[key]
+	if !ok {
+		p.times = append(p.times, key)
+		if len(p.times) > framePredictions {
+			delete(p.frames, p.times[0])
+			p.times = p.times[1:]
+		}
+	}
+	for ii := range preds {
+		if preds[ii].Model == ev.Model {
+			preds[ii] = ev
+			return
+		}
+	}
+	p.frames[key] = append(preds, ev)
+}
+
+// predictions returns the predictions received so far for the frame of a
+// camera captured at a time, sorted by model
+func (h *hub) predictions(camera string, captured time.Time) []panelEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	p, ok := h.panels[camera]
+	if !ok {
+		return nil
+	}
+	evs := append([]panelEvent(nil), p.frames[captured.UnixNano()]...)
+	sort.Slice(evs, func(a, b int) bool { return evs[a].Model < evs[b].Model })
+	return evs
+}
+
+func (h *hub) unsubscribe(c chan panelEvent) {
+	h.lock.Lock()
+	delete(h.clients, c)
+	h.lock.Unlock()
+}
+
+// serveEvents streams panel events to the dashboard as server-sent events
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	c := dashboard.subscribe()
+	defer dashboard.unsubscribe(c)
+
+	tick := time.NewTicker(heartbeat)
+	defer tick.Stop()
+	for {
+		select {
+		case ev := <-c:
+			if !allowedCamera(r, ev.Camera) {
+				continue
+			}
+			data, err := json.Marshal(struct {
+				Camera string          `json:"camera"`
+				Event  json.RawMessage `json:"event"`
+			}{ev.Camera, ev.Data})
+			if err != nil {
+				log.Println("Error in Marshal:", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			if err != nil {
+				return
+			}
+		case <-tick.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// consumeEvents feeds the dashboard from the predictions, counts and alerts
+// topics, starting from their latest messages
+func consumeEvents(c *kafka.Consumer, types map[string]string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("main.consumeEvents():PANICKED AND RESTARTING")
+			log.Println("Panic:", r)
+			go consumeEvents(c, types)
+		}
+	}()
+
+	for e := range c.Events() {
+		switch ev := e.(type) {
+		case kafka.AssignedPartitions:
+			log.Printf("%% %v\n", ev)
+			// Only live events are of interest
+			for ii := range ev.Partitions {
+				ev.Partitions[ii].Offset = kafka.OffsetEnd
+			}
+			c.Assign(ev.Partitions)
+		case kafka.RevokedPartitions:
+			log.Printf("%% %v\n", ev)
+			c.Unassign()
+		case kafka.Error:
+			log.Printf("%% Error: %v\n", ev)
+		case *kafka.Message:
+			typ := types[*ev.TopicPartition.Topic]
+			if typ == "" || !json.Valid(ev.Value) {
+				continue
+			}
+			dashboard.publish(panelEvent{Type: typ, Camera: cameraID(ev), Data: ev.Value})
+		}
+	}
+}
+
+// handleDashboard serves the dashboard at / and its events at /events, fed
+// by the topics in TOPICNAMEPREDICTIONS, TOPICNAMECOUNTS and TOPICNAMEALERTS
+func handleDashboard() {
+	types := make(map[string]string)
+	var topics []string
+	for env, typ := range map[string]string{
+		"TOPICNAMEPREDICTIONS": "prediction",
+		"TOPICNAMECOUNTS":      "counts",
+		"TOPICNAMEALERTS":      "alert",
+	} {
+		if topic := os.Getenv(env); topic != "" {
+			types[topic] = typ
+			topics = append(topics, topic)
+		}
+	}
+
+	if len(topics) > 0 {
+		c, err := confluentkafkago.NewConsumer(broker, group+"-dashboard")
+		if err != nil {
+			log.Fatal("Error in creating NewConsumer.", err)
+		}
+		err = c.SubscribeTopics(topics, nil)
+		if err != nil {
+			c.Close()
+			log.Fatal("Error in SubscribeTopics.", err)
+		}
+		go consumeEvents(c, types)
+	}
+
+	http.HandleFunc("/events", serveEvents)
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, dashboardHTML)
+	})
+}
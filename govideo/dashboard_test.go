@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFramePredictions(t *testing.T) {
+	h := &hub{panels: make(map[string]*panel), clients: make(map[chan panelEvent]bool)}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	publish := func(camera, model string, captured time.Time, label string) {
+		data, _ := json.Marshal(map[string]interface{}{"model": model, "time": captured, "label": label})
+		h.publish(panelEvent{Type: "prediction", Camera: camera, Data: data})
+	}
+	labels := func(evs []panelEvent) string {
+		var s string
+		for _, ev := range evs {
+			var pred struct{ Model, Label string }
+			json.Unmarshal(ev.Data, &pred)
+			s += pred.Model + ":" + pred.Label + " "
+		}
+		return s
+	}
+
+	publish("lobby", "ssd", start, "a")
+	publish("lobby", "imagenet", start, "b")
+	publish("lobby", "ssd", start.Add(time.Second), "c")
+	publish("door", "ssd", start, "d")
+	//A prediction published again replaces the earlier one of its model
+	publish("lobby", "ssd", start, "e")
+
+	tests := []struct {
+		camera   string
+		captured time.Time
+		want     string
+	}{
+		{"lobby", start, "imagenet:b ssd:e "},
+		{"lobby", start.Add(time.Second), "ssd:c "},
+		{"lobby", start.Add(time.Millisecond), ""},
+		{"door", start, "ssd:d "},
+		{"garage", start, ""},
+	}
+	for _, tt := range tests {
+		if got := labels(h.predictions(tt.camera, tt.captured)); got != tt.want {
+			t.Errorf("%s at %v: %q, want %q", tt.camera, tt.captured, got, tt.want)
+		}
+	}
+
+	//Only the most recent frames are kept
+	for ii := 0; ii < framePredictions; ii++ {
+		publish("lobby", "ssd", start.Add(time.Duration(ii+2)*time.Second), fmt.Sprint(ii))
+	}
+	if got := labels(h.predictions("lobby", start)); got != "" {
+		t.Errorf("oldest frame kept: %q", got)
+	}
+	if got := labels(h.predictions("lobby", start.Add(2*time.Second))); got != "ssd:0 " {
+		t.Errorf("recent frame: %q", got)
+	}
+	if p := h.panels["lobby"]; len(p.frames) != framePredictions || len(p.times) != framePredictions {
+		t.Errorf("%d frames %d times, want %d", len(p.frames), len(p.times), framePredictions)
+	}
+}
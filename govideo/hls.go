@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// Frames queued per camera for segmenting before new ones are dropped
+const hlsQueue = 32
+
+// hlsParam configures HLS output
+type hlsParam struct {
+	Dir     string  `json:"dir"`     //Directory of the segments, with a subdirectory per camera named by its hex ID
+	Segment string  `json:"segment"` //Target segment duration, e.g. "2s"
+	Window  int     `json:"window"`  //Number of segments in the playlist
+	FPS     float64 `json:"fps"`     //Frame rate of the segments
+	Codec   string  `json:"codec"`   //FourCC of the video codec, "avc1" by default
+}
+
+func (param *hlsParam) validate() error {
+	if param.Dir == "" {
+		return errors.New("hls dir must be set")
+	}
+	d, err := time.ParseDuration(param.Segment)
+	if err != nil || d <= 0 {
+		return errors.New("Invalid hls segment duration " + param.Segment)
+	}
+	if param.Window <= 0 {
+		return errors.New("hls window must be positive")
+	}
+	if param.FPS <= 0 {
+		return errors.New("hls fps must be positive")
+	}
+	if param.Codec == "" {
+		param.Codec = "avc1"
+	}
+	if len(param.Codec) != 4 {
+		return errors.New("hls codec must be a FourCC")
+	}
+	return nil
+}
+
+// hlsSegment is a finished segment in the playlist
+type hlsSegment struct {
+	name     string
+	duration float64 //Seconds
+}
+
+// hlsSegmenter cuts the frames of one camera into MPEG-TS segments and
+// keeps a rolling playlist of the latest ones
+type hlsSegmenter struct {
+	param    hlsParam
+	dir      string
+	segment  time.Duration
+	frames   chan []byte
+	lock     sync.Mutex
+	closed   bool
+	segments []hlsSegment
+	sequence int //Media sequence number of the first segment in the playlist
+	next     int //Number of the next segment
+
+	// Segment being written
+	writer  *gocv.VideoWriter
+	name    string
+	size    image.Point
+	start   time.Time
+	written int
+}
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// newHLSSegmenter starts segmenting the frames of a camera into a fresh
+// directory. Cameras get a directory named by the hex encoded ID so that
+// distinct cameras never share one, and each segmenter a unique one within,
+// so that a closed segmenter of the camera still shutting down removes only
+// its own segments.
+func newHLSSegmenter(id string, param hlsParam) (*hlsSegmenter, error) {
+	camDir := filepath.Join(param.Dir, hex.EncodeToString([]byte(id)))
+	err := os.RemoveAll(camDir)
+	if err != nil {
+		return nil, errors.New("Failed to clear hls dir. " + err.Error())
+	}
+	err = os.MkdirAll(camDir, 0755)
+	if err != nil {
+		return nil, errors.New("Failed to create hls dir. " + err.Error())
+	}
+	dir, err := ioutil.TempDir(camDir, "")
+	if err != nil {
+		return nil, errors.New("Failed to create hls dir. " + err.Error())
+	}
+	os.Chmod(dir, 0755)
+	segment, _ := time.ParseDuration(param.Segment)
+
+	h := &hlsSegmenter{
+		param:   param,
+		dir:     dir,
+		segment: segment,
+		frames:  make(chan []byte, hlsQueue),
+	}
+	go h.run()
+	return h, nil
+}
+
+// add queues a JPEG frame, dropping it if the segmenter is behind or
+// closed
+func (h *hlsSegmenter) add(jpeg []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return
+	}
+	select {
+	case h.frames <- jpeg:
+	default:
+	}
+}
+
+// close stops segmenting and removes the segments
+func (h *hlsSegmenter) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.closed {
+		h.closed = true
+		close(h.frames)
+	}
+}
+
+func (h *hlsSegmenter) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("main.hlsSegmenter.run():PANICKED AND RESTARTING")
+			log.Println("Panic:", r)
+			go h.run()
+		}
+	}()
+
+	for jpeg := range h.frames {
+		img, err := gocv.IMDecode(jpeg, gocv.IMReadColor)
+		if err != nil || img.Empty() {
+			log.Println("HLS: Error in IMDecode:", err)
+			continue
+		}
+		err = h.write(img, time.Now())
+		img.Close()
+		if err != nil {
+			log.Println("HLS:", err)
+		}
+	}
+
+	if h.writer != nil {
+		h.writer.Close()
+	}
+	os.RemoveAll(h.dir)
+}
+
+// write adds a frame to the current segment, repeating or dropping frames
+// to keep the segment at the configured frame rate
+func (h *hlsSegmenter) write(img gocv.Mat, now time.Time) error {
+	size := image.Pt(img.Cols(), img.Rows())
+	if h.writer != nil && (size != h.size || now.Sub(h.start) >= h.segment) {
+		h.finish()
+	}
+	if h.writer == nil {
+		h.name = fmt.Sprintf("segment%d.ts", h.next)
+		writer, err := gocv.VideoWriterFile(filepath.Join(h.dir, h.name), h.param.Codec, h.param.FPS, size.X, size.Y, true)
+		if err != nil {
+			return errors.New("Failed to open segment. " + err.Error())
+		}
+		if !writer.IsOpened() {
+			writer.Close()
+			return errors.New("Failed to open segment, check that OpenCV has an FFmpeg " + h.param.Codec + " encoder")
+		}
+		h.writer, h.size, h.start, h.written = writer, size, now, 0
+		h.next++
+	}
+
+	due := int(now.Sub(h.start).Seconds()*h.param.FPS) + 1
+	for h.written < due {
+		err := h.writer.Write(img)
+		if err != nil {
+			return errors.New("Failed to write segment. " + err.Error())
+		}
+		h.written++
+	}
+	return nil
+}
+
+// finish closes the current segment, adds it to the playlist and removes
+// segments which left the window
+func (h *hlsSegmenter) finish() {
+	h.writer.Close()
+	h.writer = nil
+
+	h.lock.Lock()
+	h.segments = append(h.segments, hlsSegment{
+		name:     h.name,
+		duration: float64(h.written) / h.param.FPS,
+	})
+	for len(h.segments) > h.param.Window {
+		os.Remove(filepath.Join(h.dir, h.segments[0].name))
+		h.segments = h.segments[1:]
+		h.sequence++
+	}
+	h.lock.Unlock()
+}
+
+// playlist returns the live playlist of the finished segments. Each segment
+// is written by a new encoder, restarting its timestamps, so each follows a
+// discontinuity.
+func (h *hlsSegmenter) playlist() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	target := h.segment.Seconds()
+	for _, s := range h.segments {
+		target = math.Max(target, s.duration)
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", h.sequence)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", h.sequence)
+	for _, s := range h.segments {
+		b.WriteString("#EXT-X-DISCONTINUITY\n")
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", s.duration, s.name)
+	}
+	return b.String()
+}
+
+// serveHLS responds with the playlist of a camera at index.m3u8, or one of
+// its segments
+func serveHLS(w http.ResponseWriter, r *http.Request, cam *camera, name string) {
+	if cam.hls == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if name == "index.m3u8" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, cam.hls.playlist())
+		return
+	}
+
+	if !strings.HasSuffix(name, ".ts") || unsafeName.MatchString(strings.TrimSuffix(name, ".ts")) {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cam.hls.dir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(data)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPlaylist(t *testing.T) {
+	h := &hlsSegmenter{
+		segment:  2 * time.Second,
+		sequence: 3,
+		segments: []hlsSegment{{"segment3.ts", 2}, {"segment4.ts", 2.4}},
+	}
+	want := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-TARGETDURATION:3\n" +
+		"#EXT-X-MEDIA-SEQUENCE:3\n" +
+		"#EXT-X-DISCONTINUITY-SEQUENCE:3\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXTINF:2.000,\nsegment3.ts\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXTINF:2.400,\nsegment4.ts\n"
+	if got := h.playlist(); got != want {
+		t.Errorf("playlist\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSegmenterDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	param := hlsParam{Dir: dir, Segment: "2s", Window: 3, FPS: 10, Codec: "avc1"}
+
+	//IDs differing only in unsafe characters get their own directories
+	seen := make(map[string]bool)
+	for _, id := range []string{"lobby/1", "lobby_1", "lobby 1", "../lobby"} {
+		h, err := newHLSSegmenter(id, param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.close()
+		camDir := filepath.Dir(h.dir)
+		if filepath.Dir(camDir) != dir || seen[camDir] {
+			t.Errorf("camera %q in %s", id, h.dir)
+		}
+		seen[camDir] = true
+	}
+
+	//A camera coming back keeps its segments while the segmenter it had
+	//before shuts down
+	old, err := newHLSSegmenter("garage", param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.close()
+	h, err := newHLSSegmenter("garage", param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	if h.dir == old.dir {
+		t.Fatalf("segmenters share %s", h.dir)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(old.dir); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(h.dir); err != nil {
+		t.Errorf("new segmenter dir: %v", err)
+	}
+}
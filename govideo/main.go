@@ -3,9 +3,9 @@ package main
 import (
 	"confluentkafkago"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"mjpeg"
 	"net/http"
 	"os"
 	"time"
@@ -15,29 +15,74 @@ import (
 )
 
 var (
-	stream      *mjpeg.Stream
-	broker      = os.Getenv("KAFKAPORT")
-	topics      = []string{os.Getenv("TOPICNAME")}
-	group       = os.Getenv("GROUPNAME")
-	displayport = os.Getenv("DISPLAYPORT")
-	nodeport    = os.Getenv("NODEPORT")
+	frameInterval time.Duration
+	snapshotStale time.Duration
+	frameHeaders  = os.Getenv("FRAMEHEADERS") == "true"
+	hls           *hlsParam
+	wsOrigins     []string
+	broker        = os.Getenv("KAFKAPORT")
+	topics        = []string{os.Getenv("TOPICNAME")}
+	group         = os.Getenv("GROUPNAME")
+	displayport   = os.Getenv("DISPLAYPORT")
+	nodeport      = os.Getenv("NODEPORT")
 )
 
 func main() {
-	frameInterval, err := time.ParseDuration(os.Getenv("FRAMEINTERVAL"))
+	var err error
+	frameInterval, err = time.ParseDuration(os.Getenv("FRAMEINTERVAL"))
 	if err != nil {
 		log.Fatal("Invalid frame interval", err)
 	}
-	// Create new mjpeg stream
-	stream = mjpeg.NewStream(frameInterval)
+	// Remove cameras which stopped sending frames
+	cameraIdle, err := time.ParseDuration(os.Getenv("CAMERAIDLE"))
+	if err != nil {
+		log.Fatal("Invalid camera idle", err)
+	}
+	go gcCameras(cameraIdle)
+	// Refuse snapshots older than this
+	snapshotStale, err = time.ParseDuration(os.Getenv("SNAPSHOTSTALE"))
+	if err != nil {
+		log.Fatal("Invalid snapshot stale", err)
+	}
+	// Segment frames for HLS
+	if val, ok := os.LookupEnv("HLS"); ok {
+		hls = &hlsParam{}
+		err = json.Unmarshal([]byte(val), hls)
+		if err != nil {
+			log.Fatal("Invalid hls", err)
+		}
+		if err := hls.validate(); err != nil {
+			log.Fatal("Invalid hls", err)
+		}
+	}
+
+	// Pages of other hosts allowed to open WebSockets
+	if val, ok := os.LookupEnv("WSORIGINS"); ok {
+		err = json.Unmarshal([]byte(val), &wsOrigins)
+		if err != nil {
+			log.Fatal("Invalid ws origins", err)
+		}
+	}
+
+	// Authenticate viewers
+	if val, ok := os.LookupEnv("AUTH"); ok {
+		param := authParam{}
+		err = json.Unmarshal([]byte(val), &param)
+		if err != nil {
+			log.Fatal("Invalid auth", err)
+		}
+		auth, err = newAuthenticator(param)
+		if err != nil {
+			log.Fatal("Invalid auth", err)
+		}
+	}
 
 	// Create new Consumer in a new ConsumerGroup
 	c, err := confluentkafkago.NewConsumer(broker, group)
 	if err != nil {
 		log.Fatal("Error in creating NewConsumer.", err)
 	}
-	// Close the consumer
-	defer c.Close()
+	// The consumer closes itself on SIGINT and SIGTERM
 
 	// Subscribe to topics
 	err = c.SubscribeTopics(topics, nil)
@@ -53,8 +98,18 @@ func main() {
 	fmt.Println("Capturing. Point your browser to " + nodeport)
 
 	// Start http server
-	http.Handle("/", stream)
-	log.Fatal(http.ListenAndServe(displayport, nil))
+	handleClips()
+	handleCameras()
+	handleDashboard()
+	var handler http.Handler = http.DefaultServeMux
+	if auth != nil {
+		handler = auth.wrap(handler)
+	}
+	err = serve(displayport, handler, os.Getenv("TLSCERT"), os.Getenv("TLSKEY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Stopped")
 }
 
 func consumeMessages(c *kafka.Consumer) {
@@ -89,28 +144,27 @@ func consumeMessages(c *kafka.Consumer) {
 		case *kafka.Message:
 
 			//Read message into `topicMsg` struct
+			*doc = topicMsg{}
 			err := json.Unmarshal(ev.Value, doc)
 			if err != nil {
 				log.Println(err)
 				continue
 			}
 
-			//Retrieve img
+			//Retrieve img and encode it to jpeg
 			log.Printf("%% Message sent %v on %s\n", ev.Timestamp, ev.TopicPartition)
-			img, err := gocv.NewMatFromBytes(doc.Rows, doc.Cols, doc.Type, doc.Mat)
+			buf, err := encodeFrame(doc)
 			if err != nil {
 				log.Println("Frame:", err)
 				continue
 			}
 
-			//Encode gocv mat to jpeg
-			buf, err := gocv.IMEncode(gocv.JPEGFileExt, img)
-			if err != nil {
-				log.Println("Error in IMEncode:", err)
-				continue
+			// Keep the capture time of frames from producers predating it
+			captured := doc.Timestamp
+			if captured.IsZero() {
+				captured = ev.Timestamp
 			}
-
-			stream.UpdateJPEG(buf)
+			updateCamera(cameraID(ev), buf, captured, doc.Seq)
 
 		default:
 			log.Println("Ignored")
@@ -122,10 +176,27 @@ func consumeMessages(c *kafka.Consumer) {
 	}
 }
 
+// encodeFrame encodes the frame of a message to jpeg
+func encodeFrame(doc *topicMsg) ([]byte, error) {
+	img, err := gocv.NewMatFromBytes(doc.Rows, doc.Cols, doc.Type, doc.Mat)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	buf, err := gocv.IMEncode(gocv.JPEGFileExt, img)
+	if err != nil {
+		return nil, errors.New("Error in IMEncode: " + err.Error())
+	}
+	return buf, nil
+}
+
 type topicMsg struct {
-	Mat      []byte       `json:"mat"`
-	Channels int          `json:"channels"`
-	Rows     int          `json:"rows"`
-	Cols     int          `json:"cols"`
-	Type     gocv.MatType `json:"type"`
+	Mat       []byte       `json:"mat"`
+	Channels  int          `json:"channels"`
+	Rows      int          `json:"rows"`
+	Cols      int          `json:"cols"`
+	Type      gocv.MatType `json:"type"`
+	Timestamp time.Time    `json:"timestamp"` //Capture time of the frame
+	Seq       uint64       `json:"seq"`       //Frame number of the camera
 }
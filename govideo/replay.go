@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mjpeg"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Limits of time-shifted playback
+const (
+	maxReplays     = 8  //Concurrent replays, each with its own consumer
+	maxReplaySpeed = 16 //Fastest playback relative to capture
+)
+
+// Free replay slots
+var replays = make(chan struct{}, maxReplays)
+
+// serveReplay streams the frames of a camera from ?from= onwards as MJPEG,
+// paced like they were captured and sped up by ?speed=. Each replay reads
+// the topic with its own consumer, apart from the live consumer group.
+func serveReplay(w http.ResponseWriter, r *http.Request, id string) {
+	q := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, q.Get("from"))
+	if err != nil {
+		http.Error(w, "from must be an RFC3339 time", http.StatusBadRequest)
+		return
+	}
+	if from.After(time.Now()) {
+		http.Error(w, "from must be in the past", http.StatusBadRequest)
+		return
+	}
+	speed := 1.0
+	if val := q.Get("speed"); val != "" {
+		speed, err = strconv.ParseFloat(val, 64)
+		if err != nil || speed <= 0 || speed > maxReplaySpeed {
+			http.Error(w, "speed must be between 0 and "+strconv.Itoa(maxReplaySpeed), http.StatusBadRequest)
+			return
+		}
+	}
+
+	select {
+	case replays <- struct{}{}:
+		defer func() { <-replays }()
+	default:
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Too many replays", http.StatusServiceUnavailable)
+		return
+	}
+
+	c, ends, err := newReplayConsumer(from)
+	if err == errNoReplay {
+		http.Error(w, "No frames of "+id+" since "+from.Format(time.RFC3339), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Replay:", err)
+		http.Error(w, "Failed to start replay", http.StatusInternalServerError)
+		return
+	}
+	log.Println("Replay:", r.RemoteAddr, "replaying", id, "from", from, "at", speed)
+
+	stream := mjpeg.NewStream(frameInterval)
+	stream.Transcode = resizeJPEG
+	stream.FrameHeaders = frameHeaders
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go replay(ctx, c, ends, id, speed, stream)
+	stream.ServeHTTP(w, r)
+}
+
+// errNoReplay is returned when no frames were stored since the replay start
+var errNoReplay = errors.New("no frames to replay")
+
+// replayPartition is a partition read by a replay
+type replayPartition struct {
+	topic     string
+	partition int32
+}
+
+// newReplayConsumer returns a consumer assigned to every partition of the
+// topics, at the first offsets at or after from, along with the offset at
+// which each partition ends the replay. Frames stored after the replay
+// started are not replayed. Offsets are never committed.
+//
+// Frames are keyed by camera, but the partition of a key depends on the
+// partitioner of the producer, so the frames of other cameras are read and
+// skipped rather than guessing the partition.
+func newReplayConsumer(from time.Time) (*kafka.Consumer, map[replayPartition]kafka.Offset, error) {
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  broker,
+		"group.id":           fmt.Sprintf("%s-replay-%d", group, time.Now().UnixNano()),
+		"enable.auto.commit": false,
+		"auto.offset.reset":  "latest",
+	})
+	if err != nil {
+		return nil, nil, errors.New("Failed to create consumer. " + err.Error())
+	}
+
+	ms := kafka.Offset(from.UnixNano() / int64(time.Millisecond))
+	var times []kafka.TopicPartition
+	for ii := range topics {
+		topic := &topics[ii]
+		md, err := c.GetMetadata(topic, false, 5000)
+		if err != nil {
+			c.Close()
+			return nil, nil, errors.New("Failed to get metadata. " + err.Error())
+		}
+		for _, p := range md.Topics[*topic].Partitions {
+			times = append(times, kafka.TopicPartition{Topic: topic, Partition: p.ID, Offset: ms})
+		}
+	}
+	offsets, err := c.OffsetsForTimes(times, 5000)
+	if err != nil {
+		c.Close()
+		return nil, nil, errors.New("Failed to get offsets for times. " + err.Error())
+	}
+
+	// Partitions without a frame since from are at their end, and would
+	// only replay live frames
+	var assigned []kafka.TopicPartition
+	ends := make(map[replayPartition]kafka.Offset)
+	for _, tp := range offsets {
+		if tp.Offset == kafka.OffsetEnd {
+			continue
+		}
+		_, high, err := c.QueryWatermarkOffsets(*tp.Topic, tp.Partition, 5000)
+		if err != nil {
+			c.Close()
+			return nil, nil, errors.New("Failed to get watermark offsets. " + err.Error())
+		}
+		if tp.Offset >= kafka.Offset(high) {
+			continue
+		}
+		assigned = append(assigned, tp)
+		ends[replayPartition{*tp.Topic, tp.Partition}] = kafka.Offset(high)
+	}
+	if len(assigned) == 0 {
+		c.Close()
+		return nil, nil, errNoReplay
+	}
+	err = c.Assign(assigned)
+	if err != nil {
+		c.Close()
+		return nil, nil, errors.New("Failed to assign offsets. " + err.Error())
+	}
+	return c, ends, nil
+}
+
+// replay pushes the frames of a camera read by c onto stream, waiting
+// between frames for the time between their captures divided by speed. It
+// closes the stream and the consumer once ctx is done or every partition
+// reached its end offset.
+func replay(ctx context.Context, c *kafka.Consumer, ends map[replayPartition]kafka.Offset, id string, speed float64, stream *mjpeg.Stream) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("main.replay():PANICKED")
+			log.Println("Panic:", r)
+		}
+		stream.Close()
+		c.Close()
+	}()
+
+	doc := &topicMsg{}
+	var first time.Time //Capture time of the first frame
+	var start time.Time //Time the first frame was pushed
+	for ctx.Err() == nil && len(ends) > 0 {
+		ev, ok := c.Poll(100).(*kafka.Message)
+		if !ok || ev.TopicPartition.Topic == nil {
+			continue
+		}
+		// Skip frames stored after the replay started
+		tp := replayPartition{*ev.TopicPartition.Topic, ev.TopicPartition.Partition}
+		end, ok := ends[tp]
+		if !ok || ev.TopicPartition.Offset >= end {
+			continue
+		}
+		if ev.TopicPartition.Offset+1 >= end {
+			delete(ends, tp)
+		}
+		if cameraID(ev) != id {
+			continue
+		}
+
+		*doc = topicMsg{}
+		err := json.Unmarshal(ev.Value, doc)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		captured := doc.Timestamp
+		if captured.IsZero() {
+			captured = ev.Timestamp
+		}
+
+		if first.IsZero() {
+			first, start = captured, time.Now()
+		}
+		due := start.Add(time.Duration(float64(captured.Sub(first)) / speed))
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		buf, err := encodeFrame(doc)
+		if err != nil {
+			log.Println("Replay:", err)
+			continue
+		}
+		stream.UpdateFrame(buf, captured, doc.Seq)
+	}
+}
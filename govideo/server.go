@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server timeouts. There is no read or write timeout, which would cut off
+// streams, so only the headers and idle keep-alive connections are bounded.
+const (
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+	shutdownTimeout   = 10 * time.Second
+)
+
+// Interval between checks of the certificate files for rotation
+const certCheck = 10 * time.Second
+
+// certReloader serves a certificate and key pair from files, reloading them
+// when either file changes
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time //Latest modification of the files loaded
+	checked  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	modified, err := c.modTime()
+	if err != nil {
+		return nil, err
+	}
+	err = c.load(modified)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// modTime returns the latest modification time of the files
+func (c *certReloader) modTime() (time.Time, error) {
+	var modified time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modified, errors.New("Failed to stat certificate. " + err.Error())
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+func (c *certReloader) load(modified time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.New("Failed to load certificate. " + err.Error())
+	}
+	c.cert = &cert
+	c.modified = modified
+	c.checked = time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the
+// files changed. A failed reload keeps the previous certificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.checked) > certCheck {
+		c.checked = time.Now()
+		modified, err := c.modTime()
+		if err == nil && !modified.Equal(c.modified) {
+			err = c.load(modified)
+			if err == nil {
+				log.Println("Reloaded certificate", c.certFile)
+			}
+		}
+		if err != nil {
+			log.Println("Certificate:", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// cancelOnShutdown cancels the context of requests once stopping closes, so
+// that long-lived streams end and the server can shut down
+func cancelOnShutdown(next http.Handler, stopping chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-stopping:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// serve serves handler on addr, over TLS with HTTP/2 if certFile and keyFile
+// are set, until SIGINT or SIGTERM. It then disconnects the clients of the
+// cameras and waits for the remaining requests to finish.
+func serve(addr string, handler http.Handler, certFile string, keyFile string) error {
+	stopping := make(chan struct{})
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           cancelOnShutdown(handler, stopping),
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	if certFile != "" || keyFile != "" {
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sig := <-sigChan
+		log.Printf("Caught signal %v: shutting down\n", sig)
+		close(stopping)
+		closeCameras()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.Println("Error in Shutdown:", err)
+		}
+	}()
+
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// Largest width a snapshot may be resized to
+const maxSnapshotWidth = 4096
+
+// serveSnapshot responds with the latest frame of a camera as a JPEG,
+// optionally resized to ?width=, or 503 if the frame is older than
+// snapshotStale
+func serveSnapshot(w http.ResponseWriter, r *http.Request, cam *camera) {
+	jpeg, updated := cam.stream.Snapshot()
+	if jpeg == nil || time.Since(updated) > snapshotStale {
+		w.Header().Set("Retry-After", strconv.Itoa(int(snapshotStale.Seconds())+1))
+		http.Error(w, "No recent frame from camera "+cam.id, http.StatusServiceUnavailable)
+		return
+	}
+
+	width := 0
+	if val := r.URL.Query().Get("width"); val != "" {
+		var err error
+		width, err = strconv.Atoi(val)
+		if err != nil || width <= 0 || width > maxSnapshotWidth {
+			http.Error(w, "Invalid width "+val, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Tag the frame and width, so that resized snapshots are cached apart
+	h := fnv.New64a()
+	h.Write(jpeg)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%d"`, h.Sum64(), width))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "image/jpeg")
+
+	// Answer conditional requests before resizing
+	if match := r.Header.Get("If-None-Match"); match != "" && match == w.Header().Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if width > 0 {
+		var err error
+		jpeg, err = resizeJPEG(jpeg, width, 0)
+		if err != nil {
+			log.Println("Snapshot:", err)
+			http.Error(w, "Failed to resize snapshot", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.ServeContent(w, r, "snapshot.jpg", updated, bytes.NewReader(jpeg))
+}
+
+// resizeJPEG scales a JPEG down to width, keeping its aspect ratio, and
+// encodes it with quality, or the encoder default for 0. Frames narrower
+// than width are only re-encoded.
+func resizeJPEG(jpeg []byte, width int, quality int) ([]byte, error) {
+	img, err := gocv.IMDecode(jpeg, gocv.IMReadColor)
+	if err != nil {
+		return nil, errors.New("Error in IMDecode: " + err.Error())
+	}
+	defer img.Close()
+	if img.Empty() {
+		return nil, errors.New("Error in IMDecode: empty image")
+	}
+
+	if width > 0 && width < img.Cols() {
+		height := img.Rows() * width / img.Cols()
+		if height < 1 {
+			height = 1
+		}
+		gocv.Resize(img, &img, image.Pt(width, height), 0, 0, gocv.InterpolationArea)
+	}
+
+	if quality == 0 {
+		return gocv.IMEncode(gocv.JPEGFileExt, img)
+	}
+	return gocv.IMEncodeWithParams(gocv.JPEGFileExt, img, []int{gocv.IMWriteJpegQuality, quality})
+}
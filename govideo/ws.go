@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"mjpeg"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"websocket"
+)
+
+// Time after which a client not taking a message is disconnected
+const wsWriteTimeout = 10 * time.Second
+
+// wsFrame precedes each binary JPEG message with the frame it carries and
+// the predictions of that frame received so far. Models lag behind the
+// stream, so predictions arriving after their frame was sent follow in
+// messages of type "predictions" carrying the same seq and timestamp.
+type wsFrame struct {
+	Type        string            `json:"type"` //"frame" or "predictions"
+	Camera      string            `json:"camera"`
+	Seq         uint64            `json:"seq"`
+	Timestamp   time.Time         `json:"timestamp"`             //Capture time of the frame
+	Predictions []json.RawMessage `json:"predictions,omitempty"` //Predictions of the frame, matched by capture time
+}
+
+// wsSent is a frame sent to a WebSocket client, awaiting late predictions
+type wsSent struct {
+	seq    uint64
+	models map[string]bool //Models whose prediction was sent
+}
+
+// wsControl is a message from the client
+type wsControl struct {
+	Predictions *bool `json:"predictions"` //Toggle sending predictions
+}
+
+// serveWebSocket pushes the frames of a camera to a WebSocket client as a
+// JSON frame message followed by a binary JPEG message. Frames the client is
+// not ready for are dropped, keeping only the latest one. The predictions
+// sent along can be turned off with ?predictions=false or by sending
+// {"predictions":false}.
+func serveWebSocket(w http.ResponseWriter, r *http.Request, cam *camera) {
+	interval := time.Duration(0)
+	if val := r.URL.Query().Get("fps"); val != "" {
+		fps, err := strconv.ParseFloat(val, 64)
+		if err != nil || fps <= 0 || fps > mjpeg.MaxFPS {
+			http.Error(w, "fps must be between 0 and "+strconv.Itoa(mjpeg.MaxFPS), http.StatusBadRequest)
+			return
+		}
+		interval = time.Duration(float64(time.Second) / fps)
+	}
+	var predictions int32 = 1
+	if r.URL.Query().Get("predictions") == "false" {
+		predictions = 0
+	}
+
+	c, ok := cam.stream.Subscribe()
+	if !ok {
+		http.Error(w, "Stream closed", http.StatusGone)
+		return
+	}
+	defer cam.stream.Unsubscribe(c)
+
+	conn, err := websocket.Upgrade(w, r, wsOrigins)
+	if err != nil {
+		log.Println("WebSocket:", err)
+		return
+	}
+	defer conn.Close()
+	conn.WriteTimeout = wsWriteTimeout
+	log.Println("WebSocket:", r.RemoteAddr, "connected to", cam.id)
+	defer log.Println("WebSocket:", r.RemoteAddr, "disconnected")
+
+	// Read toggles until the client goes away
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var ctl wsControl
+			if typ != websocket.TextMessage || json.Unmarshal(data, &ctl) != nil {
+				continue
+			}
+			if ctl.Predictions != nil {
+				if *ctl.Predictions {
+					atomic.StoreInt32(&predictions, 1)
+				} else {
+					atomic.StoreInt32(&predictions, 0)
+				}
+			}
+		}
+	}()
+
+	events := dashboard.subscribe()
+	defer dashboard.unsubscribe(events)
+	sent := make(map[int64]*wsSent)
+	var order []int64
+
+	var lastSeq uint64
+	var lastCaptured time.Time
+	next := time.Now()
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return
+			}
+		case ev := <-events:
+			if ev.Type != "prediction" || ev.Camera != cam.id || atomic.LoadInt32(&predictions) == 0 {
+				continue
+			}
+			f, ok := sent[ev.Time.UnixNano()]
+			if !ok || f.models[ev.Model] {
+				continue
+			}
+			f.models[ev.Model] = true
+			msg := wsFrame{Type: "predictions", Camera: cam.id, Seq: f.seq, Timestamp: ev.Time, Predictions: []json.RawMessage{ev.Data}}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Println("Error in Marshal:", err)
+				return
+			}
+			if conn.WriteMessage(websocket.TextMessage, data) != nil {
+				return
+			}
+			continue
+		case <-done:
+			return
+		}
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-done:
+				return
+			}
+		}
+
+		jpeg, captured, seq := cam.stream.Frame()
+		if jpeg == nil || seq == lastSeq && captured.Equal(lastCaptured) {
+			continue
+		}
+		msg := wsFrame{Type: "frame", Camera: cam.id, Seq: seq, Timestamp: captured}
+		f := &wsSent{seq: seq, models: make(map[string]bool)}
+		if atomic.LoadInt32(&predictions) == 1 {
+			for _, ev := range dashboard.predictions(cam.id, captured) {
+				msg.Predictions = append(msg.Predictions, ev.Data)
+				f.models[ev.Model] = true
+			}
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			log.Println("Error in Marshal:", err)
+			return
+		}
+		if conn.WriteMessage(websocket.TextMessage, data) != nil ||
+			conn.WriteMessage(websocket.BinaryMessage, jpeg) != nil {
+			return
+		}
+		lastSeq, lastCaptured = seq, captured
+		next = time.Now().Add(interval)
+
+		// Remember the frame for the predictions still to come
+		if captured.IsZero() {
+			continue
+		}
+		key := captured.UnixNano()
+		if _, ok := sent[key]; !ok {
+			order = append(order, key)
+			if len(order) > framePredictions {
+				delete(sent, order[0])
+				order = order[1:]
+			}
+		}
+		sent[key] = f
+	}
+}